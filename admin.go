@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	nsq "github.com/bitly/go-nsq"
+)
+
+const ADMIN_ADDR = "127.0.0.1:4180"
+
+// Status of an archiver, served by /status
+type Status struct {
+	Topic      string             `json:"topic"`
+	Source     string             `json:"source"`
+	Current    FileStatus         `json:"current"`
+	Pending    int                `json:"pending"` // messages waiting to be committed
+	Stalled    bool               `json:"stalled"`
+	Paused     bool               `json:"paused"`
+	Received   uint64             `json:"received"`
+	Committed  uint64             `json:"committed"`
+	Rejected   uint64             `json:"rejected"`
+	Rotations  uint64             `json:"rotations"`
+	Duplicates uint64             `json:"duplicates"` // redelivered messages dropped
+	Stalls     uint64             `json:"stalls"`
+	NSQ        *nsq.ConsumerStats `json:"nsq,omitempty"`
+}
+
+// FileInfo is an archive listed by /files, with its manifest once sealed
+type FileInfo struct {
+	Topic    string    `json:"topic"`
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	Cold     bool      `json:"cold"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+func (arch *Archiver) status() *Status {
+	st := &Status{
+		Topic:      arch.topic,
+		Source:     arch.cfg.Source,
+		Current:    arch.file_status(),
+		Pending:    len(arch.pending),
+		Stalled:    arch.is_stalled(),
+		Paused:     arch.is_paused(),
+		Received:   atomic.LoadUint64(&arch.received),
+		Committed:  atomic.LoadUint64(&arch.committed),
+		Rejected:   atomic.LoadUint64(&arch.rejected),
+		Rotations:  atomic.LoadUint64(&arch.rotations),
+		Duplicates: atomic.LoadUint64(&arch.duplicates),
+		Stalls:     atomic.LoadUint64(&arch.stalls),
+	}
+	if s, ok := arch.source.(*nsq_source); ok {
+		st.NSQ = s.Stats()
+	}
+	return st
+}
+
+// archives of the topic, oldest first, cold ones included
+func (arch *Archiver) files() ([]FileInfo, error) {
+	rs, err := list_retained(arch.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if p := arch.cfg.retain_policy(arch.topic); p.ColdDir != "" {
+		cold, err := list_retained(p.ColdDir, true)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(cold, rs...)
+	}
+
+	infos := make([]FileInfo, len(rs))
+	for i, r := range rs {
+		infos[i] = FileInfo{Topic: arch.topic, File: r.file, Size: r.size, Cold: r.cold}
+		if r.sealed {
+			if infos[i].Manifest, err = read_manifest(rdo_name(r.file)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return infos, nil
+}
+
+// serve the admin endpoints on addr
+func (m *Manager) admin_serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("admin listening on ", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, m.admin_handler()); err != nil {
+			log.Error("admin: ", err)
+		}
+	}()
+	return nil
+}
+
+// all endpoints take an optional ?topic=, all topics by default.
+// GET /status, /files; POST /rotate, /pause, /resume; GET/POST /snapshot
+func (m *Manager) admin_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", m.admin("GET", func(arch *Archiver) (interface{}, error) {
+		return arch.status(), nil
+	}))
+	mux.HandleFunc("/files", m.admin("GET", func(arch *Archiver) (interface{}, error) {
+		return arch.files()
+	}))
+	mux.HandleFunc("/rotate", m.admin("POST", func(arch *Archiver) (interface{}, error) {
+		arch.force_rotate()
+		return arch.topic, nil
+	}))
+	mux.HandleFunc("/pause", m.admin("POST", func(arch *Archiver) (interface{}, error) {
+		arch.pause(true)
+		return arch.topic, nil
+	}))
+	mux.HandleFunc("/resume", m.admin("POST", func(arch *Archiver) (interface{}, error) {
+		arch.pause(false)
+		return arch.topic, nil
+	}))
+	mux.HandleFunc("/snapshot", m.admin_snapshot)
+	return mux
+}
+
+// apply f to the archivers selected by ?topic=, respond the results as a json array
+func (m *Manager) admin(method string, f func(*Archiver) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		archs := m.all()
+		if topic := r.FormValue("topic"); topic != "" {
+			m.mu.Lock()
+			arch, ok := m.archivers[topic]
+			m.mu.Unlock()
+			if !ok {
+				http.Error(w, fmt.Sprintf("topic %q not archived", topic), http.StatusNotFound)
+				return
+			}
+			archs = []*Archiver{arch}
+		}
+
+		results := []interface{}{}
+		for _, arch := range archs {
+			v, err := f(arch)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%v: %v", arch.topic, err), http.StatusInternalServerError)
+				return
+			}
+			// files are flattened into a single list
+			if infos, ok := v.([]FileInfo); ok {
+				for _, info := range infos {
+					results = append(results, info)
+				}
+				continue
+			}
+			results = append(results, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
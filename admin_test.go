@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.rotate = make(chan bool, 1)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	m := &Manager{cfg: arch.cfg, archivers: map[string]*Archiver{arch.topic: arch}}
+	srv := httptest.NewServer(m.admin_handler())
+	defer srv.Close()
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	post := func(path string) int {
+		resp, err := http.Post(srv.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var status []Status
+	if code := get("/status", &status); code != http.StatusOK || len(status) != 1 || status[0].Current.File != rl.file {
+		t.Fatal("unexpected status", code, status)
+	}
+	if code := get("/status?topic=NOPE", nil); code != http.StatusNotFound {
+		t.Error("unknown topic should be 404", code)
+	}
+
+	if code := get("/pause", nil); code != http.StatusMethodNotAllowed {
+		t.Error("pause needs POST", code)
+	}
+	if code := post("/pause?topic=" + arch.topic); code != http.StatusOK || !arch.is_paused() {
+		t.Error("not paused", code)
+	}
+	get("/status", &status)
+	if !status[0].Paused {
+		t.Error("pause not in status")
+	}
+	if code := post("/resume"); code != http.StatusOK || arch.is_paused() {
+		t.Error("not resumed", code)
+	}
+
+	if code := post("/rotate"); code != http.StatusOK || len(arch.rotate) != 1 {
+		t.Error("rotation not requested", code)
+	}
+
+	var files []FileInfo
+	if code := get("/files", &files); code != http.StatusOK || len(files) != 1 || files[0].File != rl.file || files[0].Manifest != nil {
+		t.Error("unexpected files", code, files)
+	}
+}
@@ -1,18 +1,18 @@
 package main
 
 import (
-	"encoding/binary"
+	"fmt"
 	"os"
-	"os/signal"
-	"strings"
-	"syscall"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	nsq "github.com/bitly/go-nsq"
-	"github.com/boltdb/bolt"
 )
 
+// defaults, see Config
 const (
 	DEFAULT_NSQLOOKUPD   = "http://172.17.42.1:4161"
 	ENV_NSQLOOKUPD       = "NSQLOOKUPD_HOST"
@@ -21,110 +21,507 @@ const (
 	SERVICE              = "[ARCH]"
 	REDO_TIME_FORMAT     = "REDO-2006-01-02T15:04:05.RDO"
 	REDO_ROTATE_INTERVAL = 24 * time.Hour
+	REDO_ROTATE_ALIGN    = ALIGN_NONE
+	REDO_ROTATE_TIMEZONE = "UTC"
+	REDO_MAX_SIZE        = 0
+	REDO_MAX_RECORDS     = 0
 	BOLTDB_BUCKET        = "REDOLOG"
+	DEADLETTER_BUCKET    = "DEADLETTER"
+	META_BUCKET          = "META"
+	META_KEY_ID          = "key_id" // id of the key encrypting the file
 	DATA_DIRECTORY       = "/data/"
 	BATCH_SIZE           = 1024
 	SYNC_INTERVAL        = 10 * time.Millisecond
+	QUEUE_SIZE           = 16384
+	FSYNC_INTERVAL       = 100 * time.Millisecond
+	CONNECT_RETRY_MIN    = time.Second
+	CONNECT_RETRY_MAX    = time.Minute
+	TOPIC_POLL_INTERVAL  = time.Minute
 )
 
+// Archiver archives a single topic into RDO files under its own directory
 type Archiver struct {
-	pending chan []byte
-	stop    chan bool
+	rejected      uint64 // messages failed validation, keep 64-bit aligned for atomic
+	stalls        uint64 // times consumption was paused
+	received      uint64 // messages received
+	committed     uint64 // records committed
+	rotations     uint64 // files rotated
+	duplicates    uint64 // redelivered messages dropped
+	stalled       int32  // 1 while consumption is stalled, see stall
+	paused        int32  // 1 while consumption is paused by hand
+	flow          sync.Mutex
+	mu            sync.Mutex // guards current and live
+	current       FileStatus // the file being written
+	live          *redolog   // the file being written, for snapshots
+	stat_prefix   string     // statsd bucket prefix
+	cfg           *Config
+	topic         string
+	dir           string // DataDir/topic
+	source        Source
+	max_in_flight int // restored on resume
+	pending       chan *entry
+	flush         chan bool // batch size reached, commit now
+	rotate        chan bool
+	stop          chan bool
+	policy        *RotatePolicy
+	sealing       sync.WaitGroup // rotated files being sealed
+	seal_mu       sync.Mutex     // guards sealing_files
+	sealing_files map[string]bool
+	dedup         *dedup // messages last committed, nil if disabled
 }
 
-func (arch *Archiver) init() {
-	arch.pending = make(chan []byte, BATCH_SIZE)
+// FileStatus is the state of the file being written
+type FileStatus struct {
+	File       string    `json:"file"`
+	Created    time.Time `json:"created"`
+	Records    uint64    `json:"records"`
+	Size       int64     `json:"size"`
+	LastCommit time.Time `json:"last_commit"` // zero if nothing is committed since start
+}
+
+// an opened redolog file
+type redolog struct {
+	Segment
+	file         string
+	created      time.Time
+	records      uint64 // records in file
+	dead_letters uint64 // dead letters in file
+	size         int64  // file size in bytes
+	key_id       string // id of the key encrypting the file
+	codec        *codec // encodes values of the file
+	chain        []byte // hash of the last record
+	// committed but not fsynced yet with no-sync, acknowledged by fsync,
+	// the ones written are added to the dedup window then
+	unsynced       []*entry
+	unsynced_fresh []*entry
+}
+
+func (arch *Archiver) init() error {
+	arch.dir = filepath.Join(arch.cfg.DataDir, arch.topic)
+	if err := os.MkdirAll(arch.dir, 0755); err != nil {
+		return err
+	}
+	arch.pending = make(chan *entry, arch.cfg.QueueSize)
+	arch.flush = make(chan bool, 1)
+	arch.rotate = make(chan bool, 1)
 	arch.stop = make(chan bool)
-	cfg := nsq.NewConfig()
-	consumer, err := nsq.NewConsumer(TOPIC, CHANNEL, cfg)
+	arch.policy = arch.cfg.rotate_policy()
+	arch.stat_prefix = stat_prefix(arch.topic)
+	arch.dedup = new_dedup(arch.cfg.DedupWindow)
+
+	source, err := arch.cfg.new_source(arch.topic)
 	if err != nil {
-		log.Panic(err)
-		os.Exit(-1)
+		return err
+	}
+	arch.source = source
+	arch.max_in_flight = arch.cfg.max_in_flight()
+	if err := source.Start(arch.receive); err != nil {
+		return err
 	}
 
-	// message process
-	consumer.AddHandler(nsq.HandlerFunc(func(msg *nsq.Message) error {
-		arch.pending <- msg.Body
-		return nil
-	}))
+	go arch.archive_task()
+	go arch.metrics_task()
+	if arch.cfg.retain_policy(arch.topic).enabled() {
+		go arch.retain_task()
+	}
+	return nil
+}
 
-	// read environtment variable
-	addresses := []string{DEFAULT_NSQLOOKUPD}
-	if env := os.Getenv(ENV_NSQLOOKUPD); env != "" {
-		addresses = strings.Split(env, ";")
+// a message delivered by the source, FIN/REQ is deferred to archive_task
+// after the batch commits, malformed messages go to the dead-letter bucket
+func (arch *Archiver) receive(msg *nsq.Message) {
+	atomic.AddUint64(&arch.received, 1)
+	e := new_entry(msg)
+	if e.rec == nil {
+		atomic.AddUint64(&arch.rejected, 1)
+		log.Warnf("%v reject message %s: %v", arch.topic, msg.ID[:], e.reason)
 	}
+	arch.enqueue(e)
+}
 
-	// connect to nsqlookupd
-	log.Debug("connect to nsqlookupds ip:", addresses)
-	if err := consumer.ConnectToNSQLookupds(addresses); err != nil {
-		log.Error(err)
-		return
+// stop consuming, in-flight messages keep being committed until the source
+// has all of them acknowledged, then the current file is closed and
+// arch.stop is closed.
+func (arch *Archiver) shutdown() {
+	arch.source.Stop()
+}
+
+// queue an entry for the writer, its value is prepared here, by the
+// concurrent handlers of the source, to keep the writer busy with writing
+// only. a full batch is committed right away.
+func (arch *Archiver) enqueue(e *entry) {
+	e.prepare(arch.cfg.Compression)
+	arch.pending <- e
+	if len(arch.pending) >= arch.cfg.BatchSize {
+		select {
+		case arch.flush <- true:
+		default: // already signaled
+		}
 	}
-	log.Info("nsqlookupd connected")
+}
 
-	go arch.archive_task()
+// trigger a rotation of the current redolog
+func (arch *Archiver) force_rotate() {
+	select {
+	case arch.rotate <- true:
+	default: // already requested
+	}
+}
+
+// rotation timer of the current redolog, nil if there is none
+func (arch *Archiver) timer(rl *redolog) <-chan time.Time {
+	if rl == nil {
+		return nil
+	}
+	return arch.policy.timer(rl.created)
 }
 
+// commits pending messages once a batch is full or the oldest has waited
+// for the sync interval. consumption stalls on low disk space or when
+// the redolog can't be written, until a disk check finds it writable again.
 func (arch *Archiver) archive_task() {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM)
-	timer := time.After(REDO_ROTATE_INTERVAL)
-	sync_ticker := time.NewTicker(SYNC_INTERVAL)
-	db := arch.new_redolog()
-	key := make([]byte, 8)
+	arch.archive(arch.source.Done())
+}
+
+func (arch *Archiver) archive(stop <-chan int) {
+	sync_ticker := time.NewTicker(arch.cfg.SyncInterval.Duration)
+	defer sync_ticker.Stop()
+	disk_ticker := time.NewTicker(DISK_CHECK_INTERVAL)
+	defer disk_ticker.Stop()
+	var fsync <-chan time.Time
+	if arch.cfg.NoSync {
+		fsync_ticker := time.NewTicker(arch.cfg.FsyncInterval.Duration)
+		defer fsync_ticker.Stop()
+		fsync = fsync_ticker.C
+	}
+
+	arch.load_dedup()
+	rl, err := arch.open_redolog()
+	if err != nil {
+		arch.stall(err)
+	}
+	timer := arch.timer(rl)
 	for {
 		select {
+		case <-arch.flush:
 		case <-sync_ticker.C:
-			n := len(arch.pending)
-			if n == 0 {
+		case <-fsync:
+			if rl != nil {
+				if err := arch.fsync(rl); err != nil {
+					arch.stall(err)
+				}
+			}
+			continue
+		case <-disk_ticker.C:
+			if !arch.check_disk() || !arch.is_stalled() {
 				continue
 			}
-
-			db.Update(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte(BOLTDB_BUCKET))
-				for i := 0; i < n; i++ {
-					id, err := b.NextSequence()
-					if err != nil {
-						log.Error(err)
-						continue
-					}
-					binary.BigEndian.PutUint64(key, uint64(id))
-					if err = b.Put(key, <-arch.pending); err != nil {
-						log.Error(err)
-						continue
-					}
+			if rl == nil {
+				if rl, err = arch.open_redolog(); err != nil {
+					log.Error(err)
+					continue
 				}
-				return nil
-			})
+				timer = arch.timer(rl)
+			}
+			arch.resume()
+			continue
 		case <-timer:
-			db.Close()
-			// rotate redolog
-			db = arch.new_redolog()
-			timer = time.After(REDO_ROTATE_INTERVAL)
-		case <-sig:
-			db.Close()
-			log.Info("SIGTERM")
-			os.Exit(0)
+			if rl, err = arch.rotate_redolog(rl); err != nil {
+				arch.stall(err)
+			}
+			timer = arch.timer(rl)
+			continue
+		case <-arch.rotate:
+			if rl == nil {
+				continue
+			}
+			if rl, err = arch.rotate_redolog(rl); err != nil {
+				arch.stall(err)
+			}
+			timer = arch.timer(rl)
+			continue
+		case <-stop:
+			// flush what's left and close the file. it's resumed on next
+			// start within its rotation period, so it's only sealed now once
+			// that's over or it's full. wait for files being sealed
+			if rl != nil && !arch.is_stalled() && arch.commit(rl, len(arch.pending)) == nil {
+				if err := arch.close_redolog(rl); err != nil {
+					log.Error(err)
+				}
+			} else {
+				arch.requeue(len(arch.pending))
+				if rl != nil {
+					arch.close_redolog(rl)
+				}
+			}
+			if rl != nil && (arch.policy.expired(rl.created, time.Now()) || arch.policy.full(rl.size, rl.records)) {
+				arch.seal_async(rl.file, rl.created)
+			}
+			arch.sealing.Wait()
+			log.Info(arch.topic, " archiver stopped")
+			close(arch.stop)
+			return
+		}
+
+		// a batch is full or the sync interval passed
+		if arch.is_stalled() {
+			arch.requeue(len(arch.pending))
+			continue
+		}
+		if err := arch.commit(rl, len(arch.pending)); err != nil {
+			arch.stall(err)
+			continue
+		}
+		if arch.policy.full(rl.size, rl.records) {
+			rl, err = arch.rotate_redolog(rl)
+			if err != nil {
+				arch.stall(err)
+			}
+			timer = arch.timer(rl)
 		}
 	}
 }
 
-func (arch *Archiver) new_redolog() *bolt.DB {
-	file := DATA_DIRECTORY + time.Now().Format(REDO_TIME_FORMAT)
-	log.Info(file)
-	db, err := bolt.Open(file, 0600, nil)
+// commit n pending messages in a single transaction,
+// then FIN them on success or REQ them on failure
+func (arch *Archiver) commit(rl *redolog, n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	entries := make([]*entry, n)
+	for i := 0; i < n; i++ {
+		entries[i] = <-arch.pending
+	}
+	fresh := arch.dedup_filter(entries)
+
+	start := time.Now()
+	batch, err := rl.batch(fresh)
+	if err == nil {
+		err = rl.Append(batch)
+	}
+
+	// acknowledge only after the transaction is durable, with no-sync
+	// that's after the next fsync
 	if err != nil {
-		log.Panic(err)
-		os.Exit(-1)
+		for _, e := range entries {
+			e.msg.RequeueWithoutBackoff(-1)
+		}
+		return fmt.Errorf("commit %v: %v", rl.file, err)
+	}
+	if arch.cfg.NoSync {
+		rl.unsynced = append(rl.unsynced, entries...)
+		rl.unsynced_fresh = append(rl.unsynced_fresh, fresh...)
+	} else {
+		for _, e := range entries {
+			e.msg.Finish()
+		}
+		arch.dedup.commit(fresh)
+	}
+	if n := len(batch.Records); n > 0 {
+		rl.records = batch.Records[n-1].Seq
+		rl.chain = batch.Records[n-1].Hash
+	}
+	if n := len(batch.DeadLetters); n > 0 {
+		rl.dead_letters = batch.DeadLetters[n-1].Seq
+	}
+	rl.stat()
+	arch.track(rl, time.Now())
+	arch.stat_commit(n, uint64(len(batch.Records)), time.Since(start))
+	return nil
+}
+
+// encode entries into a batch following the file, records are chained,
+// rejected messages go to the dead letters
+func (rl *redolog) batch(entries []*entry) (*Batch, error) {
+	batch := new(Batch)
+	seq, dead_seq, chain := rl.records, rl.dead_letters, rl.chain
+	for _, e := range entries {
+		if e.rec == nil {
+			bin, err := e.dead_letter()
+			if err != nil {
+				return nil, err
+			}
+			dead_seq++
+			v, err := rl.codec.encode(seq_key(dead_seq), bin)
+			if err != nil {
+				return nil, err
+			}
+			batch.DeadLetters = append(batch.DeadLetters, Record{Seq: dead_seq, Value: v})
+			continue
+		}
+
+		seq++
+		key := seq_key(seq)
+		v, err := rl.codec.encode_entry(key, e)
+		if err != nil {
+			return nil, err
+		}
+		chain = chain_hash(chain, key, v)
+		batch.Records = append(batch.Records, Record{Seq: seq, Value: v, Hash: chain, Rec: e.rec})
+	}
+	return batch, nil
+}
+
+// fsync a redolog written with no-sync, then FIN the messages committed
+// since the last fsync. they're REQ on failure, and may be written twice,
+// as they're not in the dedup window until synced.
+func (arch *Archiver) fsync(rl *redolog) error {
+	if len(rl.unsynced) == 0 {
+		return nil
 	}
-	// create bulket
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte(BOLTDB_BUCKET))
+	err := rl.Sync()
+	for _, e := range rl.unsynced {
 		if err != nil {
-			log.Errorf("create bucket: %s", err)
-			return err
+			e.msg.RequeueWithoutBackoff(-1)
+		} else {
+			e.msg.Finish()
 		}
+	}
+	if err == nil {
+		arch.dedup.commit(rl.unsynced_fresh)
+	}
+	rl.unsynced, rl.unsynced_fresh = nil, nil
+	if err != nil {
+		return fmt.Errorf("fsync %v: %v", rl.file, err)
+	}
+	return nil
+}
+
+// fsync and close a redolog
+func (arch *Archiver) close_redolog(rl *redolog) error {
+	err := arch.fsync(rl)
+	if e := rl.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// open the redolog to append to at startup, the latest RDO file is resumed
+// if it's still within its rotation window, otherwise a new file is created.
+// older files left unsealed are sealed in background.
+func (arch *Archiver) open_redolog() (*redolog, error) {
+	rl := arch.resume_redolog()
+	if rl == nil {
+		// chain to the last file
+		var prev []byte
+		if file, _, ok := latest_redolog(arch.dir); ok {
+			tail, err := arch.cfg.file_chain_tail(file)
+			if err != nil {
+				log.Errorf("read chain of %v: %v", file, err)
+			}
+			prev = tail
+		}
+		now := time.Now()
+		var err error
+		if rl, err = arch.new_redolog(filepath.Join(arch.dir, now.Format(REDO_TIME_FORMAT)), now, prev); err != nil {
+			return nil, err
+		}
+	}
+	arch.seal_unsealed(rl.file)
+	return rl, nil
+}
+
+func (arch *Archiver) resume_redolog() *redolog {
+	file, created, ok := latest_redolog(arch.dir)
+	if !ok || arch.policy.expired(created, time.Now()) {
+		return nil
+	}
+	if m, _ := read_manifest(file); m != nil || arch.is_sealing(file) {
+		return nil
+	}
+	// switched to another storage backend
+	if st, err := arch.cfg.file_storage(file); err != nil || st != arch.cfg.storage() {
+		return nil
+	}
+
+	log.Info("resume redolog")
+	rl, err := arch.new_redolog(file, created, nil)
+	if err != nil {
+		log.Error(err)
 		return nil
-	})
-	return db
+	}
+	if arch.policy.full(rl.size, rl.records) || rl.key_id != arch.cfg.KeyID || rl.codec == nil {
+		rl.Close()
+		return nil
+	}
+	return rl
+}
+
+// seal the current redolog and start a new one, chained to it
+func (arch *Archiver) rotate_redolog(rl *redolog) (*redolog, error) {
+	now := time.Now()
+	file := filepath.Join(arch.dir, now.Format(REDO_TIME_FORMAT))
+	if file == rl.file {
+		// file names have a resolution of one second
+		log.Warn("rotate too frequently, keep ", file)
+		return rl, nil
+	}
+	if err := arch.close_redolog(rl); err != nil {
+		log.Error(err)
+	}
+	arch.seal_async(rl.file, rl.created)
+	atomic.AddUint64(&arch.rotations, 1)
+	return arch.new_redolog(file, now, rl.chain)
+}
+
+// open or create a RDO file, a new file chains to prev
+func (arch *Archiver) new_redolog(file string, created time.Time, prev []byte) (*redolog, error) {
+	log.Info(file)
+	seg, err := arch.cfg.storage().Create(file, prev, arch.cfg.KeyID, arch.cfg.NoSync)
+	if err != nil {
+		return nil, err
+	}
+	rl := &redolog{Segment: seg, file: file, created: created, key_id: seg.KeyID()}
+	rl.records, rl.dead_letters, rl.chain = seg.Tail()
+	if rl.codec, err = arch.cfg.codec(rl.key_id); err != nil {
+		// can't be written without its own key, never resumed
+		log.Error(file, ": ", err)
+	}
+	rl.stat()
+	arch.track(rl, time.Time{})
+	return rl, nil
+}
+
+// remember the state of the current file, commit is the time of the
+// last commit, zero to keep it
+func (arch *Archiver) track(rl *redolog, commit time.Time) {
+	arch.mu.Lock()
+	defer arch.mu.Unlock()
+	if commit.IsZero() {
+		commit = arch.current.LastCommit
+	}
+	arch.current = FileStatus{rl.file, rl.created, rl.records, rl.size, commit}
+	arch.live = rl
+}
+
+func (arch *Archiver) file_status() FileStatus {
+	arch.mu.Lock()
+	defer arch.mu.Unlock()
+	return arch.current
+}
+
+// refresh the file size
+func (rl *redolog) stat() {
+	rl.size = rl.Size()
+}
+
+// find the newest RDO file in dir, along with the time encoded in its name
+func latest_redolog(dir string) (file string, created time.Time, ok bool) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.RDO"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, f := range files {
+		tm, err := time.ParseInLocation(REDO_TIME_FORMAT, filepath.Base(f), time.Local)
+		if err != nil {
+			continue
+		}
+		if !ok || tm.After(created) {
+			file, created, ok = f, tm, true
+		}
+	}
+	return
 }
@@ -1,7 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	nsq "github.com/bitly/go-nsq"
+	"github.com/boltdb/bolt"
 	redo "github.com/gonet2/libs/nsq-redo"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -31,5 +43,403 @@ const TS_MASK = 0x1FFFFFFFFFF
 
 func ts() uint64 {
 	t := time.Now().UnixNano() / int64(time.Millisecond)
-	return (uint64(t) & TS_MASK) << 22
+	return (uint64(t) & TS_MASK) << TS_SHIFT
+}
+
+func TestLatestRedolog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, ok := latest_redolog(dir); ok {
+		t.Fatal("empty directory should have no redolog")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	names := []string{
+		now.Add(-48 * time.Hour).Format(REDO_TIME_FORMAT),
+		now.Format(REDO_TIME_FORMAT),
+		now.Add(-time.Hour).Format(REDO_TIME_FORMAT),
+		"garbage.RDO",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, created, ok := latest_redolog(dir)
+	if !ok {
+		t.Fatal("redolog not found")
+	}
+	if filepath.Base(file) != names[1] || !created.Equal(now) {
+		t.Fatal("wrong redolog", file, created)
+	}
+}
+
+// records FIN/REQ of messages
+type test_delegate struct {
+	sync.Mutex
+	finished int
+	requeued int
+}
+
+func (d *test_delegate) OnFinish(*nsq.Message) { d.Lock(); d.finished++; d.Unlock() }
+func (d *test_delegate) OnTouch(*nsq.Message)  {}
+func (d *test_delegate) OnRequeue(*nsq.Message, time.Duration, bool) {
+	d.Lock()
+	d.requeued++
+	d.Unlock()
+}
+
+func test_message(d nsq.MessageDelegate, i int, body interface{}) *nsq.Message {
+	var id nsq.MessageID
+	copy(id[:], fmt.Sprintf("%016x", i))
+	bin, ok := body.([]byte)
+	if !ok {
+		bin, _ = bson.Marshal(body)
+	}
+	msg := nsq.NewMessage(id, bin)
+	msg.Delegate = d
+	msg.DisableAutoResponse()
+	return msg
+}
+
+// an archiver writing to a temporary directory, without nsq
+func test_archiver(t testing.TB) *Archiver {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := default_config()
+	cfg.DataDir = dir
+	return &Archiver{
+		cfg:     cfg,
+		topic:   TOPIC,
+		dir:     dir,
+		pending: make(chan *entry, cfg.QueueSize),
+		flush:   make(chan bool, 1),
+		stop:    make(chan bool),
+		policy:  cfg.rotate_policy(),
+	}
+}
+
+// open the redolog of a test archiver
+func test_open(t testing.TB, arch *Archiver) *redolog {
+	rl, err := arch.open_redolog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestCommit(t *testing.T) {
+	arch := test_archiver(t)
+	arch.cfg.Compression = COMPRESSION_SNAPPY
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	d := new(test_delegate)
+	for i := 1; i <= 10; i++ {
+		r := redo.NewRedoRecord(int32(i%3+1), fmt.Sprint("api", i%2), ts())
+		r.AddChange("test", "", testdoc{"name", i})
+		arch.pending <- new_entry(test_message(d, i, r))
+	}
+	arch.pending <- new_entry(test_message(d, 11, []byte("garbage")))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.finished != 11 || d.requeued != 0 {
+		t.Fatal("unexpected acks", d.finished, d.requeued)
+	}
+	if rl.records != 10 {
+		t.Fatal("unexpected record count", rl.records)
+	}
+
+	count := func(tx *bolt.Tx, bucket string, prefix []byte) (n int) {
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			n++
+		}
+		return
+	}
+	rl.Segment.(*bolt_segment).View(func(tx *bolt.Tx) error {
+		if n := count(tx, arch.cfg.Bucket, nil); n != 10 {
+			t.Error("records:", n)
+		}
+		if n := count(tx, DEADLETTER_BUCKET, nil); n != 1 {
+			t.Error("dead letters:", n)
+		}
+		if n := count(tx, INDEX_UID, uid_prefix(1)); n != 3 {
+			t.Error("uid index:", n)
+		}
+		if n := count(tx, INDEX_API, str_prefix("api0")); n != 5 {
+			t.Error("api index:", n)
+		}
+		if n := count(tx, INDEX_COLLECTION, str_prefix("test")); n != 10 {
+			t.Error("collection index:", n)
+		}
+		if n := count(tx, INDEX_TS, nil); n != 10 {
+			t.Error("ts index:", n)
+		}
+		// index values point to records
+		k, _ := tx.Bucket([]byte(INDEX_UID)).Cursor().Seek(uid_prefix(2))
+		seq := binary.BigEndian.Uint64(k[4:])
+		r := new(RedoRecord)
+		body, env, err := decode_record(k[4:], tx.Bucket([]byte(arch.cfg.Bucket)).Get(k[4:]), rl.codec.aead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bson.Unmarshal(body, r)
+		if r.UID != 2 || seq != 1 {
+			t.Error("index points to wrong record", seq, r.UID)
+		}
+		// wrapped with where and when it's received
+		if env == nil || env.ID != fmt.Sprintf("%016x", 1) || env.Hostname != _hostname || env.Timestamp == 0 || env.Received < env.Timestamp {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+		return nil
+	})
+}
+
+// a delegate counting the records stored in the file as each message is
+// acknowledged
+type test_stored_delegate struct {
+	seg      Segment
+	stored   []int // records stored at each FIN
+	requeued []int // and at each REQ
+}
+
+func (d *test_stored_delegate) count() (n int) {
+	d.seg.Iterate(false, 0, func(uint64, []byte, []byte) error {
+		n++
+		return nil
+	})
+	return
+}
+
+func (d *test_stored_delegate) OnFinish(*nsq.Message) { d.stored = append(d.stored, d.count()) }
+func (d *test_stored_delegate) OnTouch(*nsq.Message)  {}
+func (d *test_stored_delegate) OnRequeue(*nsq.Message, time.Duration, bool) {
+	d.requeued = append(d.requeued, d.count())
+}
+
+// a segment failing to append
+type test_failing_append struct{ Segment }
+
+func (test_failing_append) Append(*Batch) error { return errors.New("append failed") }
+
+func TestCommitAck(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	// finished once the whole batch is stored
+	d := &test_stored_delegate{seg: rl.Segment}
+	for i := 1; i <= 3; i++ {
+		arch.pending <- new_entry(test_message(d, i, test_dedup_record(i)))
+	}
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(d.stored) != "[3 3 3]" || len(d.requeued) != 0 {
+		t.Fatal("finished before stored", d.stored, d.requeued)
+	}
+
+	// requeued, not finished, if the batch isn't stored
+	d = &test_stored_delegate{seg: rl.Segment}
+	seg := rl.Segment
+	rl.Segment = test_failing_append{seg}
+	for i := 4; i <= 5; i++ {
+		arch.pending <- new_entry(test_message(d, i, test_dedup_record(i)))
+	}
+	if err := arch.commit(rl, len(arch.pending)); err == nil {
+		t.Fatal("append not failed")
+	}
+	rl.Segment = seg
+	if len(d.stored) != 0 || fmt.Sprint(d.requeued) != "[3 3]" || rl.records != 3 {
+		t.Error("failed batch finished", d.stored, d.requeued, rl.records)
+	}
+}
+
+// wait until cond holds, or fail after a second
+func test_wait(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.BatchSize = 4
+	arch.cfg.SyncInterval.Duration = time.Hour
+	stop := make(chan int)
+	go arch.archive(stop)
+
+	d := new(test_delegate)
+	finished := func() int { d.Lock(); defer d.Unlock(); return d.finished }
+	push := func(i int) {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		arch.enqueue(new_entry(test_message(d, i, r)))
+	}
+	for i := 1; i <= 4; i++ {
+		push(i)
+	}
+	// a full batch commits without waiting for the sync interval
+	test_wait(t, "full batch", func() bool { return finished() == 4 })
+	push(5)
+	time.Sleep(20 * time.Millisecond)
+	if n := finished(); n != 4 {
+		t.Error("partial batch committed before the sync interval", n)
+	}
+	close(stop)
+	<-arch.stop
+	if n := finished(); n != 5 {
+		t.Error("pending messages not committed on stop", n)
+	}
+
+	// no-sync acknowledges after fsync
+	arch = test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.BatchSize = 4
+	arch.cfg.NoSync = true
+	arch.cfg.FsyncInterval.Duration = time.Hour
+	stop = make(chan int)
+	go arch.archive(stop)
+
+	d = new(test_delegate)
+	for i := 1; i <= 4; i++ {
+		push(i)
+	}
+	test_wait(t, "no-sync commit", func() bool { return arch.file_status().Records == 4 })
+	if n := finished(); n != 0 {
+		t.Error("acknowledged before fsync", n)
+	}
+	close(stop)
+	<-arch.stop
+	if n := finished(); n != 4 {
+		t.Error("not acknowledged on close", n)
+	}
+}
+
+// messages queued on stop are committed, or requeued while stalled, and a
+// full file is sealed
+func TestArchiveStop(t *testing.T) {
+	for _, stalled := range []bool{false, true} {
+		arch := test_archiver(t)
+		defer os.RemoveAll(arch.dir)
+		arch.cfg.SyncInterval.Duration = time.Hour
+		arch.policy.MaxRecords = 3
+		if stalled {
+			arch.stalled = 1
+		}
+		stop := make(chan int)
+		go arch.archive(stop)
+
+		d := new(test_delegate)
+		for i := 1; i <= 3; i++ {
+			r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+			arch.enqueue(new_entry(test_message(d, i, r)))
+		}
+		close(stop)
+		<-arch.stop
+		if d.finished+d.requeued != 3 || (stalled && d.requeued != 3) || (!stalled && d.finished != 3) {
+			t.Error("queued messages not acknowledged on stop", stalled, d.finished, d.requeued)
+		}
+		file, _, _ := latest_redolog(arch.dir)
+		if m, _ := read_manifest(file); (m != nil) == stalled {
+			t.Error("unexpected seal on stop", stalled, m)
+		}
+	}
+}
+
+// counts down FIN of benchmark messages
+type bench_delegate struct{ sync.WaitGroup }
+
+func (d *bench_delegate) OnFinish(*nsq.Message)                       { d.Done() }
+func (d *bench_delegate) OnTouch(*nsq.Message)                        {}
+func (d *bench_delegate) OnRequeue(*nsq.Message, time.Duration, bool) {}
+
+// push b.N messages through an archiver run by loop, until all are FIN
+func bench_archive(b *testing.B, queue int, loop func(arch *Archiver, stop chan int), push func(arch *Archiver, e *entry)) {
+	bench_handlers(b, queue, 1, COMPRESSION_NONE, loop, push)
+}
+
+// push by handlers concurrently, like the handlers of a nsq consumer
+func bench_handlers(b *testing.B, queue, handlers int, compression string, loop func(arch *Archiver, stop chan int), push func(arch *Archiver, e *entry)) {
+	arch := test_archiver(b)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.Compression = compression
+	arch.pending = make(chan *entry, queue)
+	d := new(bench_delegate)
+	msgs := make([]*nsq.Message, b.N)
+	for i := range msgs {
+		r := RedoRecord{API: "test", UID: int32(i%1000 + 1), TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		msgs[i] = test_message(d, i, r)
+	}
+	d.Add(b.N)
+	stop := make(chan int)
+	b.ResetTimer()
+	go loop(arch, stop)
+	for h := 0; h < handlers; h++ {
+		go func(h int) {
+			for i := h; i < len(msgs); i += handlers {
+				push(arch, new_entry(msgs[i]))
+			}
+		}(h)
+	}
+	d.Wait()
+	b.StopTimer()
+	close(stop)
+	<-arch.stop
+}
+
+// the group-commit pipeline
+func BenchmarkArchive(b *testing.B) {
+	bench_archive(b, QUEUE_SIZE, func(arch *Archiver, stop chan int) {
+		arch.archive(stop)
+	}, (*Archiver).enqueue)
+}
+
+// snappy compressed records decoded and prepared by a single handler, or
+// by a handler per CPU (-cpu)
+func BenchmarkArchiveSerial(b *testing.B) {
+	bench_handlers(b, QUEUE_SIZE, 1, COMPRESSION_SNAPPY, func(arch *Archiver, stop chan int) {
+		arch.archive(stop)
+	}, (*Archiver).enqueue)
+}
+
+func BenchmarkArchiveConcurrent(b *testing.B) {
+	bench_handlers(b, QUEUE_SIZE, runtime.GOMAXPROCS(0), COMPRESSION_SNAPPY, func(arch *Archiver, stop chan int) {
+		arch.archive(stop)
+	}, (*Archiver).enqueue)
+}
+
+// the former loop, a queue of one batch drained every sync interval
+func BenchmarkArchiveTicker(b *testing.B) {
+	bench_archive(b, BATCH_SIZE, func(arch *Archiver, stop chan int) {
+		rl := test_open(b, arch)
+		ticker := time.NewTicker(SYNC_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				arch.commit(rl, len(arch.pending))
+			case <-stop:
+				rl.Close()
+				close(arch.stop)
+				return
+			}
+		}
+	}, func(arch *Archiver, e *entry) {
+		arch.pending <- e
+	})
 }
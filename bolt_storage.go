@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// segments are bolt files, records are kept in bucket, along with the
+// DEADLETTER, CHAIN, META and index buckets
+type bolt_storage struct {
+	bucket string
+}
+
+type bolt_segment struct {
+	*bolt.DB
+	bucket       string
+	key_id       string
+	records      uint64 // last record sequence
+	dead_letters uint64 // last dead letter sequence
+	chain        []byte // hash of the last record
+	size         int64
+}
+
+func seq_key(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func open_bolt(file string, readonly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readonly})
+	if err == bolt.ErrTimeout {
+		return nil, ERR_LOCKED
+	}
+	return db, err
+}
+
+func (st bolt_storage) Create(file string, prev []byte, key_id string, nosync bool) (Segment, error) {
+	db, err := open_bolt(file, false)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", file, err)
+	}
+	db.NoSync = nosync
+	s := &bolt_segment{DB: db, bucket: st.bucket}
+	// create bulket
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([]string{DEADLETTER_BUCKET, CHAIN_BUCKET}, index_buckets...) {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(st.bucket))
+		if err != nil {
+			return err
+		}
+
+		// a new file is chained to prev and encrypted with key_id
+		meta, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+		if err != nil {
+			return err
+		}
+		first, _ := b.Cursor().First()
+		empty := first == nil
+		if meta.Get([]byte(META_PREV_HASH)) == nil && empty {
+			if err := meta.Put([]byte(META_PREV_HASH), prev); err != nil {
+				return err
+			}
+		}
+		if v := meta.Get([]byte(META_KEY_ID)); v != nil {
+			s.key_id = string(v)
+		} else if empty && key_id != "" {
+			s.key_id = key_id
+			if err := meta.Put([]byte(META_KEY_ID), []byte(key_id)); err != nil {
+				return err
+			}
+		}
+		s.load(tx)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets in %v: %v", file, err)
+	}
+	return s, nil
+}
+
+func (st bolt_storage) Open(file string) (Segment, error) {
+	db, err := open_bolt(file, true)
+	if err != nil {
+		return nil, err
+	}
+	s := &bolt_segment{DB: db, bucket: st.bucket}
+	db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(META_BUCKET)); meta != nil {
+			s.key_id = string(meta.Get([]byte(META_KEY_ID)))
+		}
+		s.load(tx)
+		return nil
+	})
+	return s, nil
+}
+
+// compact a closed file into a fresh bolt file without free pages
+func (st bolt_storage) Seal(file string) error {
+	tmp := file + COMPACT_SUFFIX
+	os.Remove(tmp) // left by an interrupted seal
+	if err := compact(file, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// keys are sequences, so the last ones are the counts
+func (s *bolt_segment) load(tx *bolt.Tx) {
+	if b := tx.Bucket([]byte(s.bucket)); b != nil {
+		if k, _ := b.Cursor().Last(); k != nil {
+			s.records = binary.BigEndian.Uint64(k)
+		}
+	}
+	if b := tx.Bucket([]byte(DEADLETTER_BUCKET)); b != nil {
+		if k, _ := b.Cursor().Last(); k != nil {
+			s.dead_letters = binary.BigEndian.Uint64(k)
+		}
+	}
+	s.chain = chain_tail(tx)
+	s.size = tx.Size()
+}
+
+// records, their hashes and indexes are written in a single transaction
+func (s *bolt_segment) Append(batch *Batch) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.bucket))
+		hashes := tx.Bucket([]byte(CHAIN_BUCKET))
+		for _, r := range batch.Records {
+			if err := put_seq(b, r); err != nil {
+				return err
+			}
+			if err := hashes.Put(seq_key(r.Seq), r.Hash); err != nil {
+				return err
+			}
+			if err := put_indexes(tx, r.Rec, r.Seq); err != nil {
+				return err
+			}
+		}
+		dlq := tx.Bucket([]byte(DEADLETTER_BUCKET))
+		for _, r := range batch.DeadLetters {
+			if err := put_seq(dlq, r); err != nil {
+				return err
+			}
+		}
+
+		if n := len(batch.Records); n > 0 {
+			s.records = batch.Records[n-1].Seq
+			s.chain = batch.Records[n-1].Hash
+		}
+		if n := len(batch.DeadLetters); n > 0 {
+			s.dead_letters = batch.DeadLetters[n-1].Seq
+		}
+		s.size = tx.Size()
+		return nil
+	})
+}
+
+// sequences are assigned by the writer, the bucket sequence keeps in step
+func put_seq(b *bolt.Bucket, r Record) error {
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	if id != r.Seq {
+		return fmt.Errorf("sequence %v, expect %v", r.Seq, id)
+	}
+	return b.Put(seq_key(r.Seq), r.Value)
+}
+
+func (s *bolt_segment) Get(seq uint64) (v []byte, err error) {
+	err = s.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(s.bucket)); b != nil {
+			v = append([]byte(nil), b.Get(seq_key(seq))...)
+		}
+		return nil
+	})
+	if len(v) == 0 {
+		v = nil
+	}
+	return v, s.error(err)
+}
+
+func (s *bolt_segment) Iterate(dead bool, from uint64, fn func(seq uint64, v, hash []byte) error) error {
+	name := s.bucket
+	if dead {
+		name = DEADLETTER_BUCKET
+	}
+	return s.error(s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		var hashes *bolt.Bucket
+		if !dead {
+			hashes = tx.Bucket([]byte(CHAIN_BUCKET))
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(seq_key(from)); k != nil; k, v = c.Next() {
+			if len(k) != 8 {
+				return fmt.Errorf("invalid key %x in %v", k, name)
+			}
+			var hash []byte
+			if hashes != nil {
+				hash = hashes.Get(k)
+			}
+			if err := fn(binary.BigEndian.Uint64(k), v, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (s *bolt_segment) Tail() (uint64, uint64, []byte) { return s.records, s.dead_letters, s.chain }
+func (s *bolt_segment) KeyID() string                  { return s.key_id }
+func (s *bolt_segment) Size() int64                    { return s.size }
+
+func (s *bolt_segment) Info() (*SegmentInfo, error) {
+	info := &SegmentInfo{KeyID: s.key_id}
+	err := s.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(s.bucket)); b != nil {
+			info.Records = uint64(b.Stats().KeyN)
+			c := b.Cursor()
+			if k, _ := c.First(); k != nil {
+				info.FirstSeq = binary.BigEndian.Uint64(k)
+			}
+			if k, _ := c.Last(); k != nil {
+				info.LastSeq = binary.BigEndian.Uint64(k)
+			}
+		}
+		if b := tx.Bucket([]byte(DEADLETTER_BUCKET)); b != nil {
+			info.DeadLetters = uint64(b.Stats().KeyN)
+		}
+		if b := tx.Bucket([]byte(META_BUCKET)); b != nil {
+			info.PrevHash = append([]byte(nil), b.Get([]byte(META_PREV_HASH))...)
+		}
+		info.Chained = tx.Bucket([]byte(CHAIN_BUCKET)) != nil
+		info.LastHash = chain_tail(tx)
+		if b := tx.Bucket([]byte(INDEX_TS)); b != nil {
+			c := b.Cursor()
+			if k, _ := c.First(); k != nil {
+				info.MinTS = binary.BigEndian.Uint64(k)
+			}
+			if k, _ := c.Last(); k != nil {
+				info.MaxTS = binary.BigEndian.Uint64(k)
+			}
+		}
+		return nil
+	})
+	return info, s.error(err)
+}
+
+// copied in a read transaction, a slow w would block bolt from growing
+// the file, so w should be a local file
+func (s *bolt_segment) Snapshot(w io.Writer) (records uint64, n int64, err error) {
+	err = s.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(s.bucket)); b != nil {
+			if k, _ := b.Cursor().Last(); k != nil {
+				records = binary.BigEndian.Uint64(k)
+			}
+		}
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return records, n, s.error(err)
+}
+
+func (s *bolt_segment) error(err error) error {
+	if err == bolt.ErrDatabaseNotOpen {
+		return ERR_SEGMENT_CLOSED
+	}
+	return err
+}
+
+// copy all buckets of src into a new bolt file dst
+func compact(src, dst string) error {
+	from, err := bolt.Open(src, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	var names [][]byte
+	from.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+	})
+
+	for _, name := range names {
+		// copy in chunks, to keep the write transactions small
+		var last []byte
+		for done := false; !done; {
+			err := from.View(func(stx *bolt.Tx) error {
+				return to.Update(func(dtx *bolt.Tx) error {
+					b, err := dtx.CreateBucketIfNotExists(name)
+					if err != nil {
+						return err
+					}
+					b.FillPercent = 1.0 // keys are appended in order
+
+					sb := stx.Bucket(name)
+					c := sb.Cursor()
+					k, v := c.First()
+					if last != nil {
+						if k, v = c.Seek(last); k != nil {
+							k, v = c.Next()
+						}
+					}
+					n := 0
+					for ; k != nil && n < COMPACT_TX_SIZE; k, v = c.Next() {
+						if v == nil && sb.Bucket(k) != nil {
+							return fmt.Errorf("nested bucket %s in %s", k, name)
+						}
+						if err := b.Put(k, v); err != nil {
+							return err
+						}
+						n++
+						last = append(last[:0], k...)
+					}
+					done = k == nil
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if string(name) == META_BUCKET {
+			continue
+		}
+		if err := to.Update(func(tx *bolt.Tx) error { return restore_sequence(tx.Bucket(name)) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the sequence of a bucket isn't copied with its keys. the buckets appended
+// by put_seq are keyed by it from 1, so it's their last key, restored for
+// the compacted file to be appended again.
+func restore_sequence(b *bolt.Bucket) error {
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	first, _ := c.First()
+	last, _ := c.Last()
+	if len(first) != 8 || len(last) != 8 || binary.BigEndian.Uint64(first) != 1 {
+		return nil
+	}
+	for last := binary.BigEndian.Uint64(last); ; {
+		if id, err := b.NextSequence(); err != nil || id >= last {
+			return err
+		}
+	}
+}
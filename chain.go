@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"github.com/boltdb/bolt"
+)
+
+// records are chained by hash, the CHAIN bucket keeps for each record key
+// sha256(hash of previous record + key + stored value). the first record of a
+// file chains to the last hash of the previous file, kept in META, so editing,
+// removing or reordering a record breaks the chain from there.
+const (
+	CHAIN_BUCKET   = "CHAIN"
+	META_PREV_HASH = "prev_hash" // last hash of the previous file
+)
+
+func chain_hash(prev, key, v []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(key)
+	h.Write(v)
+	return h.Sum(nil)
+}
+
+// the hash the next record chains to, empty at the beginning of the chain
+func chain_tail(tx *bolt.Tx) []byte {
+	if b := tx.Bucket([]byte(CHAIN_BUCKET)); b != nil {
+		if k, v := b.Cursor().Last(); k != nil {
+			return append([]byte(nil), v...)
+		}
+	}
+	if b := tx.Bucket([]byte(META_BUCKET)); b != nil {
+		return append([]byte(nil), b.Get([]byte(META_PREV_HASH))...)
+	}
+	return nil
+}
+
+// the last hash of a closed RDO file
+func (cfg *Config) file_chain_tail(file string) ([]byte, error) {
+	seg, err := cfg.open_segment(file)
+	if err != nil {
+		return nil, err
+	}
+	defer seg.Close()
+	_, _, tail := seg.Tail()
+	return tail, nil
+}
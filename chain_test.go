@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChain(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+
+	// three files, each chained to the one before
+	d := new(test_delegate)
+	var files []string
+	var prev []byte
+	for f := 0; f < 3; f++ {
+		created := time.Date(2016, 7, 12, 14, f, 0, 0, time.Local)
+		file := fmt.Sprintf("%v/%v", arch.dir, created.Format(REDO_TIME_FORMAT))
+		rl, err := arch.new_redolog(file, created, prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 5; i++ {
+			r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+			arch.pending <- new_entry(test_message(d, i, r))
+		}
+		if err := arch.commit(rl, len(arch.pending)); err != nil {
+			t.Fatal(err)
+		}
+		prev = rl.chain
+		rl.Close()
+		files = append(files, file)
+	}
+
+	tail, err := arch.cfg.file_chain_tail(files[2])
+	if err != nil || !bytes.Equal(tail, prev) {
+		t.Fatal("chain tail not kept", err)
+	}
+	if ok, err := verify_data(arch.cfg, ioutil.Discard); !ok || err != nil {
+		t.Fatal("intact chain reported broken", err)
+	}
+
+	// rewrite a record of the second file along with all the hashes after it,
+	// the link to the third file breaks
+	db, err := bolt.Open(files[1], 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(arch.cfg.Bucket))
+		hashes := tx.Bucket([]byte(CHAIN_BUCKET))
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, 1)
+		last := append([]byte(nil), hashes.Get(key)...)
+		binary.BigEndian.PutUint64(key, 2)
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"forged", 2}}}}
+		body, _ := bson.Marshal(r)
+		v, _ := (&codec{}).encode(key, body)
+		if err := b.Put(key, v); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(key); k != nil; k, v = c.Next() {
+			last = chain_hash(last, k, v)
+			if err := hashes.Put(k, last); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, last := verify_file(arch.cfg, files[1], nil)
+	if r.Corrupt != 0 {
+		t.Fatalf("forged file is consistent in itself: %+v", r.Problems)
+	}
+	r, _ = verify_file(arch.cfg, files[2], last)
+	if r.Corrupt != 1 || r.Problems[0].Check != CHECK_CHAIN || r.Problems[0].Seq != 0 {
+		t.Fatalf("broken file link not reported: %+v", r.Problems)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func test_keyring(t *testing.T) *Keyring {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+	keys := "# test keys\n" +
+		"k1 000102030405060708090a0b0c0d0e0f\n" +
+		"k2 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"
+	if err := ioutil.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := load_keyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestCodec(t *testing.T) {
+	doc := bson.M{"API": "test", "UID": 1, "Changes": []bson.M{{"Collection": "test", "Doc": bson.M{"name": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}}}}
+	body, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+	keyring := test_keyring(t)
+	if keyring.latest() != "k2" {
+		t.Fatal("latest key should be the last one", keyring.latest())
+	}
+	aead, err := keyring.aead("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codecs := []*codec{
+		{compression: COMPRESSION_NONE},
+		{compression: COMPRESSION_SNAPPY},
+		{compression: COMPRESSION_NONE, key_id: "k2", aead: aead},
+		{compression: COMPRESSION_SNAPPY, key_id: "k2", aead: aead},
+	}
+	for i, c := range codecs {
+		v, err := c.encode(key, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if is_bson(v) {
+			t.Error(i, "encoded value looks like plain BSON")
+		}
+		if c.compression == COMPRESSION_SNAPPY && c.aead == nil && len(v) >= len(body) {
+			t.Error(i, "not compressed", len(v), len(body))
+		}
+		if c.aead != nil && bytes.Contains(v, []byte("aaaaaaaa")) {
+			t.Error(i, "not encrypted")
+		}
+		decoded, err := decode_value(key, v, c.aead)
+		if err != nil || !bytes.Equal(decoded, body) {
+			t.Error(i, "roundtrip failed", err)
+		}
+
+		flipped := append([]byte(nil), v...)
+		flipped[len(v)/2] ^= 0x10
+		if _, err := decode_value(key, flipped, c.aead); err != ERR_CHECKSUM {
+			t.Error(i, "expect checksum error on bit flip, got", err)
+		}
+		if _, err := decode_value(key, v[:len(v)-1], c.aead); err != ERR_CHECKSUM {
+			t.Error(i, "expect checksum error on truncation, got", err)
+		}
+
+		if c.aead != nil {
+			if _, err := decode_value(key, v, nil); err != ERR_NO_KEY {
+				t.Error(i, "expect no key error, got", err)
+			}
+			if _, err := decode_value([]byte{0, 0, 0, 0, 0, 0, 0, 2}, v, c.aead); err == nil {
+				t.Error(i, "value moved to another key should not decrypt")
+			}
+		}
+	}
+
+	// values written before the header
+	if decoded, err := decode_value(key, body, nil); err != nil || !bytes.Equal(decoded, body) {
+		t.Error("plain BSON not readable", err)
+	}
+
+	if _, err := decode_value(key, []byte{0xf0, 1, 2}, nil); err == nil {
+		t.Error("unknown version should fail")
+	}
+	if _, err := decode_value(key, []byte{CODEC_VERSION<<4 | 0x08, 1, 2}, nil); err == nil {
+		t.Error("unknown flags should fail")
+	}
+}
+
+func TestEncryptedRedolog(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.keyring = test_keyring(t)
+	arch.cfg.KeyID = "k1"
+
+	rl := test_open(t, arch)
+	if rl.key_id != "k1" || rl.codec.aead == nil {
+		t.Fatal("new file should be encrypted with the current key")
+	}
+	d := new(test_delegate)
+	r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"secret", 1}}}}
+	arch.pending <- new_entry(test_message(d, 1, r))
+	if err := arch.commit(rl, 1); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	// key id is kept in file, the file is resumed with the same key
+	rl = test_open(t, arch)
+	if rl.key_id != "k1" || rl.records != 1 {
+		t.Fatal("file not resumed", rl.key_id, rl.records)
+	}
+	rl.Close()
+
+	// not resumed once the key rotates
+	arch.cfg.KeyID = "k2"
+	if rl := arch.resume_redolog(); rl != nil {
+		rl.Close()
+		t.Fatal("file resumed with another key")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	nsq "github.com/bitly/go-nsq"
+)
+
+const (
+	ENV_CONFIG = "ARCH_CONFIG"
+	ENV_PREFIX = "ARCH_"
+)
+
+// Config holds all the archiver settings, they are resolved in order of
+// increasing priority: defaults, the json config file, environment variables
+// and command line flags.
+type Config struct {
+	Source         string     `json:"source"`           // where messages come from: nsq, http or file
+	PubAddr        string     `json:"pub_addr"`         // address of /pub with the http source
+	Input          string     `json:"input"`            // BSON stream read by the file source, - for stdin
+	NSQDs          stringlist `json:"nsqd"`             // nsqd tcp addresses
+	NSQLookupds    stringlist `json:"nsqlookupd"`       // nsqlookupd http addresses
+	Topics         stringlist `json:"topic"`            // nsq topics to archive
+	TopicPattern   string     `json:"topic_pattern"`    // regexp of topics discovered from nsqlookupd
+	Channel        string     `json:"channel"`          // nsq channel to consume from
+	DataDir        string     `json:"data_dir"`         // where RDO files are stored
+	Bucket         string     `json:"bucket"`           // boltdb bucket of records
+	Storage        string     `json:"storage"`          // storage backend of new files: bolt or segment
+	BatchSize      int        `json:"batch_size"`       // commit as soon as this many messages are pending
+	SyncInterval   Duration   `json:"sync_interval"`    // maximum time a message waits to be committed
+	QueueSize      int        `json:"queue_size"`       // capacity of the pending queue
+	Concurrency    int        `json:"concurrency"`      // nsq handlers decoding and preparing messages
+	NoSync         bool       `json:"no_sync"`          // don't fsync every commit, see FsyncInterval
+	FsyncInterval  Duration   `json:"fsync_interval"`   // interval between fsyncs with no_sync
+	DedupWindow    int        `json:"dedup_window"`     // drop messages redelivered within the last this many, 0 to disable
+	RotateInterval Duration   `json:"rotate_interval"`  // maximum lifetime of a RDO file
+	RotateAlign    string     `json:"rotate_align"`     // rotate on "hour" or "day" boundaries
+	RotateTimezone string     `json:"rotate_timezone"`  // timezone of the boundaries
+	MaxFileSize    int64      `json:"max_file_size"`    // maximum RDO file size in bytes
+	MaxFileRecords uint64     `json:"max_file_records"` // maximum records in a RDO file
+	Compression    string     `json:"compression"`      // compression of record values: none or snappy
+	KeyFile        string     `json:"key_file"`         // encrypt record values with keys in this file
+	KeyID          string     `json:"key_id"`           // key to encrypt new files, the last key in file by default
+	MinFreeSpace   int64      `json:"min_free_space"`   // stop consuming below this many free bytes on the data volume
+	RetainHot      Duration   `json:"retain_hot"`       // move sealed files older than this to the cold dir
+	ColdDir        string     `json:"cold_dir"`         // cold directory, files of a topic go to cold_dir/topic
+	ColdCompress   bool       `json:"cold_compress"`    // snappy compress files moved to the cold dir
+	RetainMaxAge   Duration   `json:"retain_max_age"`   // delete sealed files older than this
+	RetainMaxSize  int64      `json:"retain_max_size"`  // delete oldest sealed files while a topic is larger, in bytes
+	RetainDryRun   bool       `json:"retain_dry_run"`   // only log retention actions
+	AdminAddr      string     `json:"admin_addr"`       // address of the admin http server, empty to disable
+	NSQ            nsqopts    `json:"nsq"`              // go-nsq options, eg: max_in_flight
+
+	location *time.Location
+	pattern  *regexp.Regexp
+	keyring  *Keyring
+}
+
+func default_config() *Config {
+	return &Config{
+		Source:         SOURCE_NSQ,
+		PubAddr:        PUB_ADDR,
+		Input:          STDIN,
+		NSQLookupds:    stringlist{DEFAULT_NSQLOOKUPD},
+		Topics:         stringlist{TOPIC},
+		Channel:        CHANNEL,
+		DataDir:        DATA_DIRECTORY,
+		Bucket:         BOLTDB_BUCKET,
+		Storage:        STORAGE_BOLT,
+		BatchSize:      BATCH_SIZE,
+		SyncInterval:   Duration{SYNC_INTERVAL},
+		QueueSize:      QUEUE_SIZE,
+		Concurrency:    runtime.NumCPU(),
+		FsyncInterval:  Duration{FSYNC_INTERVAL},
+		DedupWindow:    DEDUP_WINDOW,
+		RotateInterval: Duration{REDO_ROTATE_INTERVAL},
+		RotateAlign:    REDO_ROTATE_ALIGN,
+		RotateTimezone: REDO_ROTATE_TIMEZONE,
+		MaxFileSize:    REDO_MAX_SIZE,
+		MaxFileRecords: REDO_MAX_RECORDS,
+		Compression:    COMPRESSION_NONE,
+		MinFreeSpace:   MIN_FREE_SPACE,
+		AdminAddr:      ADMIN_ADDR,
+		NSQ:            nsqopts{},
+	}
+}
+
+// register flags bound to the config fields
+func (cfg *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Source, "source", cfg.Source, "where messages come from: nsq, http (POST /pub?topic= on pub-addr) or file (BSON documents of input)")
+	fs.StringVar(&cfg.PubAddr, "pub-addr", cfg.PubAddr, "address of /pub with -source http")
+	fs.StringVar(&cfg.Input, "input", cfg.Input, "file of BSON documents with -source file, - for stdin")
+	fs.Var(&cfg.NSQDs, "nsqd", "nsqd tcp addresses to connect directly, separated by ';'")
+	fs.Var(&cfg.NSQLookupds, "nsqlookupd", "nsqlookupd http addresses, separated by ';', empty to disable")
+	fs.Var(&cfg.Topics, "topic", "nsq topics to archive, separated by ';'")
+	fs.StringVar(&cfg.TopicPattern, "topic-pattern", cfg.TopicPattern, "regexp of topics to archive, discovered from nsqlookupd")
+	fs.StringVar(&cfg.Channel, "channel", cfg.Channel, "nsq channel to consume from")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory of RDO files")
+	fs.StringVar(&cfg.Bucket, "bucket", cfg.Bucket, "boltdb bucket of records")
+	fs.StringVar(&cfg.Storage, "storage", cfg.Storage, "storage backend of new files: bolt or segment")
+	fs.IntVar(&cfg.BatchSize, "batch-size", cfg.BatchSize, "commit as soon as this many messages are pending")
+	fs.Var(&cfg.SyncInterval, "sync-interval", "maximum time a message waits to be committed")
+	fs.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize, "capacity of the pending queue")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "nsq handlers decoding and preparing messages concurrently, the number of CPUs by default")
+	fs.BoolVar(&cfg.NoSync, "no-sync", cfg.NoSync, "fsync every fsync-interval instead of every commit, messages are acknowledged after the fsync")
+	fs.Var(&cfg.FsyncInterval, "fsync-interval", "interval between fsyncs with -no-sync")
+	fs.IntVar(&cfg.DedupWindow, "dedup-window", cfg.DedupWindow, "drop messages with the nsq id or the (UID, TS, API) of one of the last this many committed, 0 to disable")
+	fs.Var(&cfg.RotateInterval, "rotate-interval", "maximum lifetime of a RDO file, 0 to disable")
+	fs.StringVar(&cfg.RotateAlign, "rotate-align", cfg.RotateAlign, "rotate on wall-clock boundaries: hour or day")
+	fs.StringVar(&cfg.RotateTimezone, "rotate-timezone", cfg.RotateTimezone, "timezone of the wall-clock boundaries")
+	fs.Int64Var(&cfg.MaxFileSize, "max-file-size", cfg.MaxFileSize, "maximum RDO file size in bytes, 0 to disable")
+	fs.Uint64Var(&cfg.MaxFileRecords, "max-file-records", cfg.MaxFileRecords, "maximum records in a RDO file, 0 to disable")
+	fs.StringVar(&cfg.Compression, "compression", cfg.Compression, "compression of record values: none or snappy")
+	fs.StringVar(&cfg.KeyFile, "key-file", cfg.KeyFile, "encrypt record values with AES-GCM, key file of '<id> <hex key>' lines")
+	fs.StringVar(&cfg.KeyID, "key-id", cfg.KeyID, "id of the key to encrypt new files, the last key in key file by default")
+	fs.Int64Var(&cfg.MinFreeSpace, "min-free-space", cfg.MinFreeSpace, "stop consuming while the data volume has less free bytes, 0 to disable")
+	fs.Var(&cfg.RetainHot, "retain-hot", "move sealed files older than this to the cold dir, 0 to keep all hot")
+	fs.StringVar(&cfg.ColdDir, "cold-dir", cfg.ColdDir, "cold directory, files of a topic are moved to cold-dir/topic")
+	fs.BoolVar(&cfg.ColdCompress, "cold-compress", cfg.ColdCompress, "snappy compress files moved to the cold dir")
+	fs.Var(&cfg.RetainMaxAge, "retain-max-age", "delete sealed files older than this, 0 to keep forever")
+	fs.Int64Var(&cfg.RetainMaxSize, "retain-max-size", cfg.RetainMaxSize, "delete the oldest sealed files while a topic is larger than this in bytes, 0 to disable")
+	fs.BoolVar(&cfg.RetainDryRun, "retain-dry-run", cfg.RetainDryRun, "only log retention actions, without moving or deleting")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", cfg.AdminAddr, "address of the admin http server, empty to disable")
+	fs.Var(&cfg.NSQ, "nsq-opt", "go-nsq option as key=value, eg: max_in_flight=1024 (may be given multiple times)")
+}
+
+// environment variable overriding a flag, eg: data-dir -> ARCH_DATA_DIR
+func env_name(flag string) string {
+	if flag == "nsqlookupd" {
+		return ENV_NSQLOOKUPD
+	}
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// load the config from the json file, environment and command line arguments
+func load_config(args []string) (*Config, error) {
+	// first pass only looks for the config file
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(ENV_CONFIG), "json config file")
+	default_config().flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := default_config()
+	if *path != "" {
+		bts, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(bts, cfg); err != nil {
+			return nil, fmt.Errorf("%v: %v", *path, err)
+		}
+	}
+
+	fs = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard) // usage has been printed in the first pass
+	fs.String("config", "", "json config file")
+	cfg.flags(fs)
+
+	// environment variables
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := os.Getenv(env_name(f.Name)); v != "" && f.Name != "config" && err == nil {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("%v: %v", env_name(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// command line flags
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Source == SOURCE_NSQ && len(cfg.NSQDs) == 0 && len(cfg.NSQLookupds) == 0 {
+		return errors.New("no nsqd or nsqlookupd address")
+	}
+	for _, addr := range cfg.NSQDs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid nsqd address %q: %v", addr, err)
+		}
+	}
+	for _, topic := range cfg.Topics {
+		if !nsq.IsValidTopicName(topic) {
+			return fmt.Errorf("invalid topic name: %q", topic)
+		}
+	}
+	if cfg.TopicPattern != "" {
+		pattern, err := regexp.Compile(cfg.TopicPattern)
+		if err != nil {
+			return fmt.Errorf("invalid topic pattern: %v", err)
+		}
+		// topics are discovered from nsqlookupd, or posted with the http source
+		if cfg.Source == SOURCE_NSQ && len(cfg.NSQLookupds) == 0 {
+			return errors.New("topic pattern requires nsqlookupd")
+		}
+		cfg.pattern = pattern
+	}
+	if len(cfg.Topics) == 0 && cfg.pattern == nil {
+		return errors.New("no topic to archive")
+	}
+	switch cfg.Source {
+	case SOURCE_NSQ, SOURCE_HTTP:
+	case SOURCE_FILE:
+		// a single stream feeds a single topic
+		if len(cfg.Topics) != 1 || cfg.pattern != nil {
+			return errors.New("file source requires exactly one topic, without pattern")
+		}
+	default:
+		return fmt.Errorf("invalid source: %q", cfg.Source)
+	}
+	if !nsq.IsValidChannelName(cfg.Channel) {
+		return fmt.Errorf("invalid channel name: %q", cfg.Channel)
+	}
+	if fi, err := os.Stat(cfg.DataDir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", cfg.DataDir)
+	}
+	// must not clash with the buckets used by the archiver itself
+	for _, name := range append([]string{"", DEADLETTER_BUCKET, META_BUCKET, CHAIN_BUCKET}, index_buckets...) {
+		if cfg.Bucket == name {
+			return fmt.Errorf("invalid bucket name: %q", cfg.Bucket)
+		}
+	}
+	switch cfg.Storage {
+	case STORAGE_BOLT, STORAGE_SEGMENT:
+	default:
+		return fmt.Errorf("invalid storage: %q", cfg.Storage)
+	}
+	if cfg.BatchSize <= 0 {
+		return fmt.Errorf("invalid batch size: %v", cfg.BatchSize)
+	}
+	if cfg.SyncInterval.Duration <= 0 {
+		return fmt.Errorf("invalid sync interval: %v", cfg.SyncInterval)
+	}
+	if cfg.Concurrency <= 0 {
+		return fmt.Errorf("invalid concurrency: %v", cfg.Concurrency)
+	}
+	if cfg.QueueSize < cfg.BatchSize {
+		return fmt.Errorf("queue size %v smaller than batch size %v", cfg.QueueSize, cfg.BatchSize)
+	}
+	if cfg.NoSync && cfg.FsyncInterval.Duration <= 0 {
+		return fmt.Errorf("invalid fsync interval: %v", cfg.FsyncInterval)
+	}
+	if cfg.DedupWindow < 0 {
+		return fmt.Errorf("invalid dedup window: %v", cfg.DedupWindow)
+	}
+	if cfg.RotateInterval.Duration < 0 {
+		return fmt.Errorf("invalid rotate interval: %v", cfg.RotateInterval)
+	}
+	switch cfg.RotateAlign {
+	case ALIGN_NONE, ALIGN_HOUR, ALIGN_DAY:
+	default:
+		return fmt.Errorf("invalid rotate align: %q", cfg.RotateAlign)
+	}
+	loc, err := time.LoadLocation(cfg.RotateTimezone)
+	if err != nil {
+		return err
+	}
+	cfg.location = loc
+	if cfg.MaxFileSize < 0 {
+		return fmt.Errorf("invalid max file size: %v", cfg.MaxFileSize)
+	}
+	if cfg.RetainHot.Duration < 0 || cfg.RetainMaxAge.Duration < 0 || cfg.RetainMaxSize < 0 {
+		return errors.New("invalid retention: negative limit")
+	}
+	if cfg.RetainHot.Duration > 0 && cfg.ColdDir == "" {
+		return errors.New("retain hot requires cold dir")
+	}
+	if cfg.ColdDir != "" && filepath.Clean(cfg.ColdDir) == filepath.Clean(cfg.DataDir) {
+		return errors.New("cold dir must differ from data dir")
+	}
+	switch cfg.Compression {
+	case COMPRESSION_NONE, COMPRESSION_SNAPPY:
+	default:
+		return fmt.Errorf("invalid compression: %q", cfg.Compression)
+	}
+	if cfg.KeyFile != "" {
+		keyring, err := load_keyring(cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		if cfg.KeyID == "" {
+			cfg.KeyID = keyring.latest()
+		}
+		if _, err := keyring.aead(cfg.KeyID); err != nil {
+			return err
+		}
+		cfg.keyring = keyring
+	} else if cfg.KeyID != "" {
+		return errors.New("key id without key file")
+	}
+	_, err = cfg.nsq_config()
+	return err
+}
+
+// build the go-nsq config, messages stay in flight until their batch
+// commits, so max_in_flight defaults to the queue size.
+func (cfg *Config) nsq_config() (*nsq.Config, error) {
+	c := nsq.NewConfig()
+	c.MaxInFlight = cfg.QueueSize
+	for _, k := range cfg.NSQ.keys() {
+		if err := c.Set(k, cfg.NSQ[k]); err != nil {
+			return nil, fmt.Errorf("nsq option %v: %v", k, err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// the codec of values written with a key, empty key id for no encryption
+func (cfg *Config) codec(key_id string) (*codec, error) {
+	c := &codec{compression: cfg.Compression, key_id: key_id}
+	if key_id != "" {
+		if cfg.keyring == nil {
+			return nil, fmt.Errorf("encrypted with key %q, but no key file", key_id)
+		}
+		aead, err := cfg.keyring.aead(key_id)
+		if err != nil {
+			return nil, err
+		}
+		c.aead = aead
+	}
+	return c, nil
+}
+
+func (cfg *Config) rotate_policy() *RotatePolicy {
+	return &RotatePolicy{
+		Interval:   cfg.RotateInterval.Duration,
+		Align:      cfg.RotateAlign,
+		Location:   cfg.location,
+		MaxSize:    cfg.MaxFileSize,
+		MaxRecords: cfg.MaxFileRecords,
+	}
+}
+
+func (cfg *Config) retain_policy(topic string) *RetainPolicy {
+	p := &RetainPolicy{
+		Hot:      cfg.RetainHot.Duration,
+		Compress: cfg.ColdCompress,
+		MaxAge:   cfg.RetainMaxAge.Duration,
+		MaxSize:  cfg.RetainMaxSize,
+		DryRun:   cfg.RetainDryRun,
+	}
+	if cfg.ColdDir != "" {
+		p.ColdDir = filepath.Join(cfg.ColdDir, topic)
+	}
+	return p
+}
+
+// Duration is a time.Duration written as "10ms", "24h" in json and flags
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(s string) (err error) {
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+func (d *Duration) UnmarshalJSON(bts []byte) error {
+	var s string
+	if err := json.Unmarshal(bts, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// a list of strings separated by ';'
+type stringlist []string
+
+func (l *stringlist) String() string { return strings.Join(*l, ";") }
+func (l *stringlist) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// accepts either a json array or a string separated by ';'
+func (l *stringlist) UnmarshalJSON(bts []byte) error {
+	var s string
+	if err := json.Unmarshal(bts, &s); err == nil {
+		return l.Set(s)
+	}
+	return json.Unmarshal(bts, (*[]string)(l))
+}
+
+// go-nsq options, accumulated from "key=value" pairs separated by ';'
+type nsqopts map[string]string
+
+func (o nsqopts) keys() []string {
+	var keys []string
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (o nsqopts) String() string {
+	var pairs []string
+	for _, k := range o.keys() {
+		pairs = append(pairs, k+"="+o[k])
+	}
+	return strings.Join(pairs, ";")
+}
+
+func (o nsqopts) Set(s string) error {
+	for _, pair := range strings.Split(s, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid nsq option %q, expect key=value", pair)
+		}
+		o[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func (o *nsqopts) UnmarshalJSON(bts []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return err
+	}
+	if *o == nil {
+		*o = nsqopts{}
+	}
+	for k, raw := range m {
+		// strings are unquoted, numbers and bools are kept as written
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			s = string(raw)
+		}
+		(*o)[k] = s
+	}
+	return nil
+}
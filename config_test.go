@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "arch.json")
+	json := `{
+		"nsqlookupd": ["http://c:4161"],
+		"topic": "WORLD1;WORLD2",
+		"topic_pattern": "^WORLD[0-9]+$",
+		"channel": "FILE",
+		"data_dir": "` + dir + `",
+		"sync_interval": "50ms",
+		"rotate_align": "day",
+		"nsq": {"max_in_flight": 64, "msg_timeout": "2m"}
+	}`
+	if err := ioutil.WriteFile(path, []byte(json), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("ARCH_CHANNEL", "ENV")
+	os.Setenv("ARCH_BATCH_SIZE", "4096")
+	defer os.Unsetenv("ARCH_CHANNEL")
+	defer os.Unsetenv("ARCH_BATCH_SIZE")
+
+	cfg, err := load_config([]string{"-config", path, "-channel", "FLAG", "-nsqlookupd", "http://a:4161;http://b:4161"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Topics) != 2 || cfg.Topics[0] != "WORLD1" || cfg.pattern == nil {
+		t.Error("topics from file not applied:", cfg.Topics, cfg.TopicPattern)
+	}
+	if cfg.Channel != "FLAG" {
+		t.Error("flag should override env and file:", cfg.Channel)
+	}
+	if cfg.BatchSize != 4096 {
+		t.Error("env not applied:", cfg.BatchSize)
+	}
+	if cfg.SyncInterval.Duration != 50*time.Millisecond {
+		t.Error("duration from file not applied:", cfg.SyncInterval)
+	}
+	if cfg.RotateInterval.Duration != REDO_ROTATE_INTERVAL {
+		t.Error("default not kept:", cfg.RotateInterval)
+	}
+	if len(cfg.NSQDs) != 0 {
+		t.Error("nsqd should be empty by default:", cfg.NSQDs)
+	}
+	if len(cfg.NSQLookupds) != 2 || cfg.NSQLookupds[1] != "http://b:4161" {
+		t.Error("nsqlookupd list not parsed:", cfg.NSQLookupds)
+	}
+
+	nsqcfg, err := cfg.nsq_config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsqcfg.MaxInFlight != 64 || nsqcfg.MsgTimeout != 2*time.Minute {
+		t.Error("nsq options not applied:", nsqcfg.MaxInFlight, nsqcfg.MsgTimeout)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := [][]string{
+		{"-topic", "bad topic"},
+		{"-topic", ""},
+		{"-topic-pattern", "WORLD("},
+		{"-topic-pattern", "WORLD", "-nsqlookupd", "", "-nsqd", "127.0.0.1:4150"},
+		{"-batch-size", "0"},
+		{"-rotate-align", "week"},
+		{"-compression", "gzip"},
+		{"-rotate-timezone", "Mars/Olympus"},
+		{"-nsq-opt", "no_such_option=1"},
+		{"-data-dir", filepath.Join(dir, "missing")},
+		{"-nsqlookupd", ""},
+		{"-nsqd", "http://127.0.0.1:4151/pub"},
+		{"-retain-hot", "24h"},
+		{"-cold-dir", dir},
+		{"-retain-max-size", "-1"},
+		{"-dedup-window", "-1"},
+		{"-concurrency", "0"},
+	}
+	for _, args := range invalid {
+		if _, err := load_config(append([]string{"-data-dir", dir}, args...)); err == nil {
+			t.Error("expect error for", args)
+		}
+	}
+}
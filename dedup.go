@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const DEDUP_WINDOW = 65536
+
+// a window of the last messages committed. a message redelivered by nsq
+// keeps its id, a record published twice keeps its identity (UID, TS, API),
+// either one in the window makes a message a duplicate.
+type dedup struct {
+	size int
+	ring []dedup_key // committed messages, the oldest at next once full
+	next int
+	ids  map[string]int // slots of the ring holding each key
+	recs map[string]int
+}
+
+type dedup_key struct {
+	id  string // nsq message id, empty for records archived without one
+	rec string // record identity, empty for rejected messages
+}
+
+// nil if size is 0, a nil window holds nothing
+func new_dedup(size int) *dedup {
+	if size <= 0 {
+		return nil
+	}
+	return &dedup{size: size, ids: make(map[string]int), recs: make(map[string]int)}
+}
+
+func record_identity(uid int32, ts uint64, api string) string {
+	key := make([]byte, 12, 12+len(api))
+	binary.BigEndian.PutUint32(key, uint32(uid))
+	binary.BigEndian.PutUint64(key[4:], ts)
+	return string(append(key, api...))
+}
+
+func entry_key(e *entry) dedup_key {
+	k := dedup_key{id: string(e.msg.ID[:])}
+	if e.rec != nil {
+		k.rec = record_identity(e.rec.UID, e.rec.TS, e.rec.API)
+	}
+	return k
+}
+
+func (d *dedup) has(k dedup_key) bool {
+	return (k.id != "" && d.ids[k.id] > 0) || (k.rec != "" && d.recs[k.rec] > 0)
+}
+
+// the oldest message is evicted once the window is full. a key may be held
+// by several slots, e.g. a redelivery written again before the first copy is
+// synced, so it's kept until the last of them is evicted.
+func (d *dedup) add(k dedup_key) {
+	if len(d.ring) < d.size {
+		d.ring = append(d.ring, k)
+	} else {
+		old := d.ring[d.next]
+		release(d.ids, old.id)
+		release(d.recs, old.rec)
+		d.ring[d.next] = k
+		d.next = (d.next + 1) % d.size
+	}
+	if k.id != "" {
+		d.ids[k.id]++
+	}
+	if k.rec != "" {
+		d.recs[k.rec]++
+	}
+}
+
+func release(keys map[string]int, k string) {
+	if k == "" {
+		return
+	}
+	if keys[k]--; keys[k] <= 0 {
+		delete(keys, k)
+	}
+}
+
+// split entries into the ones to commit and the duplicates, of the window
+// or of the entries before them
+func (d *dedup) filter(entries []*entry) (fresh, dups []*entry) {
+	if d == nil {
+		return entries, nil
+	}
+	batch := new_dedup(len(entries))
+	for _, e := range entries {
+		k := entry_key(e)
+		if d.has(k) || batch.has(k) {
+			dups = append(dups, e)
+			continue
+		}
+		batch.add(k)
+		fresh = append(fresh, e)
+	}
+	return fresh, dups
+}
+
+// remember the entries committed
+func (d *dedup) commit(entries []*entry) {
+	if d == nil {
+		return
+	}
+	for _, e := range entries {
+		d.add(entry_key(e))
+	}
+}
+
+// drop the duplicates among entries, they're acknowledged along with the
+// batch, as their first copies are committed already or in the same batch
+func (arch *Archiver) dedup_filter(entries []*entry) []*entry {
+	fresh, dups := arch.dedup.filter(entries)
+	for _, e := range dups {
+		log.Debugf("%v duplicate message %s", arch.topic, e.msg.ID[:])
+	}
+	atomic.AddUint64(&arch.duplicates, uint64(len(dups)))
+	return fresh
+}
+
+// seed the window with the last records archived, so it carries over
+// restarts as it does over rotations. it's loaded before the files are
+// opened to be resumed or sealed, which would lock them.
+func (arch *Archiver) load_dedup() {
+	d := arch.dedup
+	if d == nil {
+		return
+	}
+	files, err := list_retained(arch.dir, false)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// newest file first, until the window is full
+	var keys [][]dedup_key
+	need := d.size
+	for i := len(files) - 1; i >= 0 && need > 0; i-- {
+		seg, err := arch.cfg.open_segment(files[i].file)
+		if err != nil {
+			log.Error(files[i].file, ": ", err)
+			continue
+		}
+		ks, err := arch.cfg.dedup_keys(seg, need)
+		seg.Close()
+		if err != nil {
+			log.Error(files[i].file, ": ", err)
+		}
+		keys = append(keys, ks)
+		need -= len(ks)
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		for _, k := range keys[i] {
+			if !d.has(k) {
+				d.add(k)
+			}
+		}
+	}
+	log.Infof("%v dedup window loaded %v messages", arch.topic, len(d.ring))
+}
+
+// the keys of the last n records of a segment, oldest first. records
+// without an envelope have no message id, only their identity is known.
+func (cfg *Config) dedup_keys(seg Segment, n int) ([]dedup_key, error) {
+	c, err := cfg.codec(seg.KeyID())
+	if err != nil {
+		return nil, err
+	}
+	var from uint64
+	if records, _, _ := seg.Tail(); records > uint64(n) {
+		from = records - uint64(n) + 1
+	}
+	var keys []dedup_key
+	err = seg.Iterate(false, from, func(seq uint64, v, _ []byte) error {
+		body, env, err := decode_record(seq_key(seq), v, c.aead)
+		if err != nil {
+			return nil // reported by verify
+		}
+		var r struct {
+			API string
+			UID int32
+			TS  uint64
+		}
+		if bson.Unmarshal(body, &r) != nil {
+			return nil
+		}
+		k := dedup_key{rec: record_identity(r.UID, r.TS, r.API)}
+		if env != nil {
+			k.id = env.ID
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	return keys, err
+}
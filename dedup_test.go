@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDedupWindow(t *testing.T) {
+	d := new_dedup(2)
+	k := func(i int) dedup_key {
+		return dedup_key{id: string(rune('a' + i)), rec: record_identity(int32(i), 1, "test")}
+	}
+	for i := 1; i <= 3; i++ {
+		d.add(k(i))
+	}
+	if d.has(k(1)) || !d.has(k(2)) || !d.has(k(3)) || len(d.ids) != 2 || len(d.recs) != 2 {
+		t.Fatal("oldest not evicted", len(d.ids), len(d.recs))
+	}
+	if !d.has(dedup_key{id: k(2).id}) || !d.has(dedup_key{id: "x", rec: k(3).rec}) || d.has(dedup_key{id: "x"}) {
+		t.Error("either key should match")
+	}
+
+	// a key held by two slots outlives the eviction of the first
+	d = new_dedup(2)
+	d.add(k(1))
+	d.add(dedup_key{id: k(1).id, rec: k(2).rec})
+	d.add(k(3))
+	if !d.has(dedup_key{id: k(1).id}) || d.has(dedup_key{rec: k(1).rec}) {
+		t.Error("key still held evicted")
+	}
+	d.add(k(4))
+	if d.has(dedup_key{id: k(1).id}) || len(d.ids) != 2 || len(d.recs) != 2 {
+		t.Error("key not evicted", len(d.ids), len(d.recs))
+	}
+	if new_dedup(0) != nil {
+		t.Error("window of 0 should be disabled")
+	}
+}
+
+func test_dedup_record(i int) RedoRecord {
+	return RedoRecord{API: "test", UID: int32(i), TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+}
+
+func TestDedupCommit(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.dedup = new_dedup(16)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	// a redelivery and a record published twice, in the same batch
+	d := new(test_delegate)
+	r1 := test_dedup_record(1)
+	for i := 1; i <= 3; i++ {
+		r := test_dedup_record(i)
+		if i == 1 {
+			r = r1
+		}
+		arch.enqueue(new_entry(test_message(d, i, r)))
+	}
+	arch.enqueue(new_entry(test_message(d, 1, r1)))
+	arch.enqueue(new_entry(test_message(d, 4, r1)))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	if d.finished != 5 || rl.records != 3 || arch.duplicates != 2 {
+		t.Fatal("duplicates committed", d.finished, rl.records, arch.duplicates)
+	}
+
+	// redelivered after its first copy is committed
+	arch.enqueue(new_entry(test_message(d, 2, test_dedup_record(2))))
+	arch.enqueue(new_entry(test_message(d, 5, test_dedup_record(5))))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	if d.finished != 7 || rl.records != 4 || arch.status().Duplicates != 3 {
+		t.Fatal("redelivery committed", d.finished, rl.records, arch.duplicates)
+	}
+}
+
+// a segment failing to fsync
+type test_failing_sync struct{ Segment }
+
+func (test_failing_sync) Sync() error { return errors.New("fsync failed") }
+
+func TestDedupNoSync(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.NoSync = true
+	arch.dedup = new_dedup(16)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	d := new(test_delegate)
+	r := test_dedup_record(1)
+	commit := func() {
+		arch.enqueue(new_entry(test_message(d, 1, r)))
+		if err := arch.commit(rl, len(arch.pending)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// requeued on a failed fsync, then written again once redelivered
+	commit()
+	seg := rl.Segment
+	rl.Segment = test_failing_sync{seg}
+	if err := arch.fsync(rl); err == nil || d.requeued != 1 {
+		t.Fatal("fsync not failed", err, d.requeued)
+	}
+	rl.Segment = seg
+	commit()
+	if err := arch.fsync(rl); err != nil {
+		t.Fatal(err)
+	}
+	if d.finished != 1 || rl.records != 2 || arch.duplicates != 0 {
+		t.Fatal("redelivery not written", d.finished, rl.records, arch.duplicates)
+	}
+
+	// a duplicate once synced
+	commit()
+	arch.fsync(rl)
+	if d.finished != 2 || rl.records != 2 || arch.duplicates != 1 {
+		t.Error("duplicate written", d.finished, rl.records, arch.duplicates)
+	}
+}
+
+func TestDedupReload(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.dedup = new_dedup(16)
+	rl := test_open(t, arch)
+
+	d := new(test_delegate)
+	keys := make(map[int]dedup_key)
+	commit := func(from, to int) {
+		for i := from; i <= to; i++ {
+			e := new_entry(test_message(d, i, test_dedup_record(i)))
+			keys[i] = entry_key(e)
+			arch.enqueue(e)
+		}
+		if err := arch.commit(rl, len(arch.pending)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(1, 3)
+	time.Sleep(time.Second)
+	rl, err := arch.rotate_redolog(rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(4, 5)
+	arch.close_redolog(rl)
+	arch.sealing.Wait()
+
+	// a restart loads the window from the last file, then the sealed one,
+	// the oldest are left out once it's full
+	reload := func(size int) *dedup {
+		next := test_archiver(t)
+		os.RemoveAll(next.dir)
+		next.dir = arch.dir
+		next.dedup = new_dedup(size)
+		next.load_dedup()
+		return next.dedup
+	}
+	w := reload(16)
+	for i := 1; i <= 5; i++ {
+		if !w.has(dedup_key{id: keys[i].id}) || !w.has(dedup_key{rec: keys[i].rec}) {
+			t.Error("message not loaded", i)
+		}
+	}
+	if len(w.ring) != 5 {
+		t.Error("unexpected window", len(w.ring))
+	}
+	w = reload(3)
+	if w.has(keys[2]) || !w.has(keys[3]) || !w.has(keys[5]) || len(w.ring) != 3 {
+		t.Error("unexpected window", len(w.ring))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	nsq "github.com/bitly/go-nsq"
+)
+
+const (
+	STDIN             = "-"
+	MAX_DOCUMENT_SIZE = 16 << 20 // maximum BSON document size of mongodb
+)
+
+// reads a stream of BSON documents, each starts with its own length as a
+// little endian int32, as mongodump writes them. the source is exhausted
+// once the stream is read and all its messages are committed.
+type file_source struct {
+	name      string
+	r         io.ReadCloser
+	mu        sync.Mutex
+	cond      *sync.Cond
+	max       int
+	in_flight int
+	retries   []*nsq.Message // requeued, delivered again before reading on
+	delivered int            // documents read
+	finished  int
+	stopped   bool
+	done      chan int
+}
+
+func new_file_source(name string, max_in_flight int) *file_source {
+	s := &file_source{name: name, max: max_in_flight, done: make(chan int)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *file_source) Start(handler func(*nsq.Message)) error {
+	s.r = os.Stdin
+	if s.name != STDIN {
+		f, err := os.Open(s.name)
+		if err != nil {
+			return err
+		}
+		s.r = f
+	}
+	go s.read(handler)
+	return nil
+}
+
+func (s *file_source) read(handler func(*nsq.Message)) {
+	defer close(s.done)
+	defer s.r.Close()
+	br := bufio.NewReader(s.r)
+	eof := false
+	for {
+		msg, ok := s.next(eof)
+		if !ok {
+			break
+		}
+		if msg == nil {
+			body, err := read_document(br)
+			if err != nil {
+				if err != io.EOF && !s.is_stopped() {
+					log.Errorf("read %v: %v", s.name, err)
+				}
+				eof = true
+				s.ack(nil)
+				continue
+			}
+			msg = new_message(body, s.name)
+			s.delivered++
+		}
+		msg.Delegate = s
+		handler(msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.in_flight > 0 {
+		s.cond.Wait()
+	}
+	log.Infof("%v: %v messages delivered, %v committed, %v not delivered", s.name, s.delivered, s.finished, len(s.retries))
+}
+
+// wait for a free slot and take it, along with a message to deliver again
+// if there's any, otherwise the next document is to be read. false once
+// stopped, or once the stream is read and all its messages are committed.
+func (s *file_source) next(eof bool) (*nsq.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.stopped:
+			return nil, false
+		case s.in_flight < s.max && len(s.retries) > 0:
+			msg := s.retries[0]
+			s.retries = s.retries[1:]
+			s.in_flight++
+			return msg, true
+		case s.in_flight < s.max && !eof:
+			s.in_flight++
+			return nil, true
+		case eof && s.in_flight == 0 && len(s.retries) == 0:
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+}
+
+// release the slot of a message, a requeued message is kept to be delivered again
+func (s *file_source) ack(requeued *nsq.Message) {
+	s.mu.Lock()
+	s.in_flight--
+	if requeued != nil {
+		s.retries = append(s.retries, requeued)
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *file_source) OnFinish(*nsq.Message) {
+	s.mu.Lock()
+	s.finished++
+	s.mu.Unlock()
+	s.ack(nil)
+}
+
+func (s *file_source) OnRequeue(m *nsq.Message, _ time.Duration, _ bool) {
+	retry := nsq.NewMessage(m.ID, m.Body)
+	retry.Attempts = m.Attempts + 1
+	retry.NSQDAddress = m.NSQDAddress
+	s.ack(retry)
+}
+
+func (s *file_source) OnTouch(*nsq.Message) {}
+
+func (s *file_source) ChangeMaxInFlight(n int) {
+	s.mu.Lock()
+	s.max = n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// stop reading, the rest of the stream is left unread
+func (s *file_source) Stop() {
+	s.mu.Lock()
+	stopped := s.stopped
+	s.stopped = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	if !stopped && s.r != nil {
+		s.r.Close() // unblock a read from stdin
+	}
+}
+
+func (s *file_source) Done() <-chan int { return s.done }
+
+func (s *file_source) is_stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// the next BSON document of r, io.EOF at the end of the stream
+func read_document(r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(head)
+	if n < 5 || n > MAX_DOCUMENT_SIZE {
+		return nil, fmt.Errorf("invalid document length %v", n)
+	}
+	doc := make([]byte, n)
+	copy(doc, head)
+	if _, err := io.ReadFull(r, doc[len(head):]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return doc, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	nsq "github.com/bitly/go-nsq"
+)
+
+const (
+	PUB_ADDR     = "127.0.0.1:4181"
+	MAX_MSG_SIZE = 1 << 20 // same as the default --max-msg-size of nsqd
+)
+
+// producers post messages to /pub?topic=, like the http api of nsqd. the
+// response waits for the commit: 200 OK, or 503 if the message can't be
+// committed, or while consumption is paused or stalled, to be retried then.
+type http_source struct {
+	topic   string
+	handler func(*nsq.Message)
+	window  *window
+	once    sync.Once
+	done    chan int
+}
+
+func new_http_source(topic string, max_in_flight int) *http_source {
+	return &http_source{topic: topic, window: new_window(max_in_flight), done: make(chan int)}
+}
+
+func (s *http_source) Start(handler func(*nsq.Message)) error {
+	s.handler = handler
+	return nil
+}
+
+func (s *http_source) ChangeMaxInFlight(n int) { s.window.resize(n) }
+func (s *http_source) Done() <-chan int        { return s.done }
+
+func (s *http_source) Stop() {
+	s.once.Do(func() {
+		s.window.stop()
+		go func() {
+			s.window.drain()
+			close(s.done)
+		}()
+	})
+}
+
+// the delegate of a posted message, acknowledged by the response
+type pub_delegate chan bool
+
+func (d pub_delegate) OnFinish(*nsq.Message)                       { d <- true }
+func (d pub_delegate) OnRequeue(*nsq.Message, time.Duration, bool) { d <- false }
+func (d pub_delegate) OnTouch(*nsq.Message)                        {}
+
+func (s *http_source) publish(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_MSG_SIZE+1))
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case len(body) == 0:
+		http.Error(w, "MSG_EMPTY", http.StatusBadRequest)
+		return
+	case len(body) > MAX_MSG_SIZE:
+		http.Error(w, "MSG_TOO_BIG", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.window.acquire(false) {
+		http.Error(w, "UNAVAILABLE", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.window.release()
+
+	msg := new_message(body, r.RemoteAddr)
+	ack := make(pub_delegate, 1)
+	msg.Delegate = ack
+	s.handler(msg)
+	if !<-ack {
+		http.Error(w, "UNAVAILABLE", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// serve /pub of the http source on addr
+func (m *Manager) pub_serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("pub listening on ", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, m.pub_handler()); err != nil {
+			log.Error("pub: ", err)
+		}
+	}()
+	return nil
+}
+
+// POST /pub?topic=, GET /ping
+func (m *Manager) pub_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/pub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// the body is the message, whatever its content type
+		topic := r.URL.Query().Get("topic")
+		if topic == "" {
+			http.Error(w, "MISSING_ARG_TOPIC", http.StatusBadRequest)
+			return
+		}
+		arch := m.pub_archiver(topic)
+		if arch == nil {
+			http.Error(w, "TOPIC_NOT_FOUND", http.StatusNotFound)
+			return
+		}
+		arch.source.(*http_source).publish(w, r)
+	})
+	return mux
+}
+
+// the archiver of a posted topic, topics matching the pattern are
+// archived on their first message
+func (m *Manager) pub_archiver(topic string) *Archiver {
+	m.mu.Lock()
+	arch := m.archivers[topic]
+	m.mu.Unlock()
+	if arch != nil || m.cfg.pattern == nil || !m.cfg.pattern.MatchString(topic) || !nsq.IsValidTopicName(topic) {
+		return arch
+	}
+	if err := m.start(topic); err != nil {
+		log.Error(err)
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.archivers[topic]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// secondary indexes of a RDO file, keys are prefix+sequence with empty
+// values, so a lookup is a prefix scan returning sequences in order.
+const (
+	INDEX_UID        = "IDX_UID"        // uid(4 bytes) + seq
+	INDEX_API        = "IDX_API"        // api + 0x00 + seq
+	INDEX_COLLECTION = "IDX_COLLECTION" // collection + 0x00 + seq
+	INDEX_TS         = "IDX_TS"         // millisecond of TS(8 bytes) + seq
+)
+
+// RedoRecord.TS is a snowflake id, the high bits are milliseconds
+const TS_SHIFT = 22
+
+var index_buckets = []string{INDEX_UID, INDEX_API, INDEX_COLLECTION, INDEX_TS}
+
+func ts_prefix(ts uint64) []byte {
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, ts>>TS_SHIFT)
+	return prefix
+}
+
+func uid_prefix(uid int32) []byte {
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(uid))
+	return prefix
+}
+
+func str_prefix(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func index_key(prefix []byte, seq uint64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], seq)
+	return key
+}
+
+// index a record stored at seq, within the transaction storing it
+func put_indexes(tx *bolt.Tx, rec *RedoRecord, seq uint64) error {
+	if err := tx.Bucket([]byte(INDEX_UID)).Put(index_key(uid_prefix(rec.UID), seq), nil); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(INDEX_API)).Put(index_key(str_prefix(rec.API), seq), nil); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(INDEX_TS)).Put(index_key(ts_prefix(rec.TS), seq), nil); err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(INDEX_COLLECTION))
+	for _, c := range rec.Changes {
+		if err := b.Put(index_key(str_prefix(c.Collection), seq), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
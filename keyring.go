@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring holds the AES keys used to encrypt record values, loaded from a key
+// file of "<id> <hex key>" lines, '#' starts a comment. keys are 16, 24 or 32
+// bytes for AES-128, AES-192 or AES-256. each RDO file records the id of its
+// key, so keys can rotate by appending a new one to the key file.
+type Keyring struct {
+	ids  []string // in the order of the key file
+	keys map[string][]byte
+}
+
+func load_keyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expect <id> <hex key>", path, line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		if _, ok := k.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%v:%v: duplicated key id %v", path, line, fields[0])
+		}
+		k.ids = append(k.ids, fields[0])
+		k.keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.ids) == 0 {
+		return nil, fmt.Errorf("%v: no key", path)
+	}
+	return k, nil
+}
+
+// the newest key id, the last one in the key file
+func (k *Keyring) latest() string {
+	return k.ids[len(k.ids)-1]
+}
+
+// AES-GCM of a key
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found in key file", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,9 +1,48 @@
 package main
 
-import _ "github.com/gonet2/libs/statsd-pprof"
+import (
+	"flag"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/gonet2/libs/statsd-pprof"
+)
 
 func main() {
-	arch := &Archiver{}
-	arch.init()
-	<-arch.stop
+	// "verify" checks the archived files, "retain" applies the retention
+	// policy once, both print a json report and exit non-zero on failure
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "verify" || args[0] == "retain") {
+		command, args = args[0], args[1:]
+	}
+
+	cfg, err := load_config(args)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case "verify":
+		exit(verify_data(cfg, os.Stdout))
+		return
+	case "retain":
+		exit(retain_data(cfg, os.Stdout))
+		return
+	}
+
+	m := &Manager{cfg: cfg}
+	m.init()
+	<-m.stop
+}
+
+func exit(ok bool, err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Manager runs an Archiver for each configured topic, and for each topic
+// matching the topic pattern as it shows up in nsqlookupd.
+type Manager struct {
+	cfg       *Config
+	archivers map[string]*Archiver
+	starting  map[string]chan bool // topics being started, closed once done
+	stopping  bool
+	mu        sync.Mutex
+	stop      chan bool
+}
+
+func (m *Manager) init() {
+	m.archivers = make(map[string]*Archiver)
+	m.starting = make(map[string]chan bool)
+	m.stop = make(chan bool)
+	for _, topic := range m.cfg.Topics {
+		if err := m.start(topic); err != nil {
+			log.Panic(err)
+			os.Exit(-1)
+		}
+	}
+
+	if m.cfg.pattern != nil && m.cfg.Source == SOURCE_NSQ {
+		m.discover()
+		go m.discover_task()
+	}
+	if m.cfg.Source == SOURCE_HTTP {
+		if err := m.pub_serve(m.cfg.PubAddr); err != nil {
+			log.Panic(err)
+			os.Exit(-1)
+		}
+	}
+	if m.cfg.AdminAddr != "" {
+		if err := m.admin_serve(m.cfg.AdminAddr); err != nil {
+			log.Panic(err)
+			os.Exit(-1)
+		}
+	}
+	go m.signal_task()
+}
+
+// start archiving a topic, if it's not archived yet. the archiver is
+// initialized outside the lock, the other topics aren't held up meanwhile,
+// a concurrent start of the same topic waits for it.
+func (m *Manager) start(topic string) error {
+	m.mu.Lock()
+	if _, ok := m.archivers[topic]; ok || m.stopping {
+		m.mu.Unlock()
+		return nil
+	}
+	if started, ok := m.starting[topic]; ok {
+		m.mu.Unlock()
+		<-started
+		return nil
+	}
+	started := make(chan bool)
+	m.starting[topic] = started
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.starting, topic)
+		m.mu.Unlock()
+		close(started)
+	}()
+
+	arch := &Archiver{cfg: m.cfg, topic: topic}
+	if err := arch.init(); err != nil {
+		return fmt.Errorf("topic %v: %v", topic, err)
+	}
+	m.mu.Lock()
+	stopping := m.stopping
+	if !stopping {
+		m.archivers[topic] = arch
+	}
+	m.mu.Unlock()
+	if stopping {
+		// shut down while it was starting, shutdown waits for it to drain
+		arch.shutdown()
+		<-arch.stop
+		return nil
+	}
+	log.Info("archiving topic: ", topic)
+	go m.watch(arch)
+	return nil
+}
+
+// an archiver stops by itself once a finite source is exhausted, the
+// others are stopped then
+func (m *Manager) watch(arch *Archiver) {
+	<-arch.stop
+	m.mu.Lock()
+	stopping := m.stopping
+	m.mu.Unlock()
+	if !stopping {
+		log.Info(arch.topic, " source exhausted")
+		m.shutdown()
+	}
+}
+
+// all running archivers, sorted by topic
+func (m *Manager) all() []*Archiver {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var topics []string
+	for topic := range m.archivers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	archs := make([]*Archiver, len(topics))
+	for i, topic := range topics {
+		archs[i] = m.archivers[topic]
+	}
+	return archs
+}
+
+// stop all archivers and wait for them to drain
+func (m *Manager) shutdown() {
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return
+	}
+	m.stopping = true
+	var starting []chan bool
+	for _, started := range m.starting {
+		starting = append(starting, started)
+	}
+	m.mu.Unlock()
+
+	for _, started := range starting {
+		<-started
+	}
+	archs := m.all()
+	for _, arch := range archs {
+		arch.shutdown()
+	}
+	for _, arch := range archs {
+		<-arch.stop
+	}
+	close(m.stop)
+}
+
+func (m *Manager) signal_task() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			log.Info("SIGHUP, rotate redolog")
+			for _, arch := range m.all() {
+				arch.force_rotate()
+			}
+			continue
+		}
+		log.Info(s)
+		signal.Stop(sig)
+		m.shutdown()
+		return
+	}
+}
+
+func (m *Manager) discover_task() {
+	ticker := time.NewTicker(TOPIC_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.discover()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// start archiving topics matching the pattern
+func (m *Manager) discover() {
+	for _, addr := range m.cfg.NSQLookupds {
+		topics, err := lookupd_topics(addr)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, topic := range topics {
+			if m.cfg.pattern.MatchString(topic) {
+				if err := m.start(topic); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}
+}
+
+// query the topics known by a nsqlookupd
+func lookupd_topics(addr string) ([]string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/topics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v/topics: %v", addr, resp.Status)
+	}
+
+	// older nsqlookupd wraps the response in data
+	var body struct {
+		Topics []string `json:"topics"`
+		Data   struct {
+			Topics []string `json:"topics"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Topics == nil {
+		return body.Data.Topics, nil
+	}
+	return body.Topics, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupdTopics(t *testing.T) {
+	responses := map[string]string{
+		"/v1/topics":  `{"topics":["WORLD1","WORLD2"]}`,
+		"/old/topics": `{"status_code":200,"status_txt":"OK","data":{"topics":["WORLD1","WORLD2"]}}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := responses[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	for _, prefix := range []string{"/v1", "/old"} {
+		topics, err := lookupd_topics(ts.URL + prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(topics, ";") != "WORLD1;WORLD2" {
+			t.Error(prefix, "unexpected topics:", topics)
+		}
+	}
+
+	// without scheme
+	if _, err := lookupd_topics(strings.TrimPrefix(ts.URL, "http://") + "/v1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupd_topics(ts.URL + "/missing"); err == nil {
+		t.Error("expect error on 404")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/peterbourgon/g2s"
+)
+
+// metrics go to the same statsd as statsd-pprof, under <hostname>.arch.<topic>
+const (
+	ENV_STATSD          = "STATSD_HOST"
+	DEFAULT_STATSD_HOST = "172.17.42.1:8125"
+	METRICS_INTERVAL    = 10 * time.Second
+)
+
+var (
+	_statter g2s.Statter
+)
+
+func init() {
+	addr := DEFAULT_STATSD_HOST
+	if env := os.Getenv(ENV_STATSD); env != "" {
+		addr = env
+	}
+
+	s, err := g2s.Dial("udp", addr)
+	if err == nil {
+		_statter = s
+	} else {
+		_statter = g2s.Noop()
+		log.Error(err)
+	}
+}
+
+func stat_prefix(topic string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + ".arch." + topic
+}
+
+// a batch committed
+func (arch *Archiver) stat_commit(batch int, records uint64, latency time.Duration) {
+	atomic.AddUint64(&arch.committed, records)
+	_statter.Timing(1.0, arch.stat_prefix+".commit_latency", latency)
+	_statter.Gauge(1.0, arch.stat_prefix+".batch_size", fmt.Sprint(batch))
+}
+
+// publish counters and gauges periodically, counters are sent as the
+// increments since the last publish
+func (arch *Archiver) metrics_task() {
+	ticker := time.NewTicker(METRICS_INTERVAL)
+	defer ticker.Stop()
+	var last struct{ received, committed, rejected, duplicates, rotations, stalls uint64 }
+	counter := func(name string, v uint64, last *uint64) {
+		if v > *last {
+			_statter.Counter(1.0, arch.stat_prefix+"."+name, int(v-*last))
+		}
+		*last = v
+	}
+	for {
+		select {
+		case <-ticker.C:
+			counter("received", atomic.LoadUint64(&arch.received), &last.received)
+			counter("committed", atomic.LoadUint64(&arch.committed), &last.committed)
+			counter("rejected", atomic.LoadUint64(&arch.rejected), &last.rejected)
+			counter("duplicates", atomic.LoadUint64(&arch.duplicates), &last.duplicates)
+			counter("rotations", atomic.LoadUint64(&arch.rotations), &last.rotations)
+			counter("stalls", atomic.LoadUint64(&arch.stalls), &last.stalls)
+			_statter.Gauge(1.0, arch.stat_prefix+".pending", fmt.Sprint(len(arch.pending)))
+			_statter.Gauge(1.0, arch.stat_prefix+".file_size", fmt.Sprint(arch.file_status().Size))
+			_statter.Gauge(1.0, arch.stat_prefix+".stalled", fmt.Sprint(atomic.LoadInt32(&arch.stalled)))
+			_statter.Gauge(1.0, arch.stat_prefix+".paused", fmt.Sprint(atomic.LoadInt32(&arch.paused)))
+		case <-arch.source.Done():
+			return
+		}
+	}
+}
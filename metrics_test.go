@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the buckets sent to statsd
+type test_statter struct {
+	sync.Mutex
+	counters map[string]int
+	gauges   map[string]string
+	timings  map[string]int
+}
+
+func (s *test_statter) Counter(_ float32, bucket string, n ...int) {
+	s.Lock()
+	defer s.Unlock()
+	for _, v := range n {
+		s.counters[bucket] += v
+	}
+}
+
+func (s *test_statter) Timing(_ float32, bucket string, d ...time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.timings[bucket] += len(d)
+}
+
+func (s *test_statter) Gauge(_ float32, bucket string, v ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.gauges[bucket] = v[len(v)-1]
+}
+
+func TestCommitMetrics(t *testing.T) {
+	s := &test_statter{counters: map[string]int{}, gauges: map[string]string{}, timings: map[string]int{}}
+	saved := _statter
+	_statter = s
+	defer func() { _statter = saved }()
+
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.stat_prefix = "test"
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	d := new(test_delegate)
+	for i := 1; i <= 4; i++ {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		arch.pending <- new_entry(test_message(d, i, r))
+	}
+	arch.pending <- new_entry(test_message(d, 5, []byte("garbage")))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := arch.file_status(); arch.committed != 4 || st.Size != rl.size || st.Records != 4 || st.LastCommit.IsZero() {
+		t.Error("counters not updated", arch.committed, st)
+	}
+	if s.timings["test.commit_latency"] != 1 || s.gauges["test.batch_size"] != "5" {
+		t.Error("commit not reported", s.timings, s.gauges)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	nsq "github.com/bitly/go-nsq"
+)
+
+// consumes a topic from the nsqlookupds and nsqds of the config
+type nsq_source struct {
+	*nsq.Consumer
+	topic       string
+	nsqlookupds []string
+	nsqds       []string
+	concurrency int // handlers, messages are decoded and prepared in parallel
+}
+
+func new_nsq_source(cfg *Config, topic string) (*nsq_source, error) {
+	c, err := cfg.nsq_config()
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := nsq.NewConsumer(topic, cfg.Channel, c)
+	if err != nil {
+		return nil, err
+	}
+	return &nsq_source{consumer, topic, cfg.NSQLookupds, cfg.NSQDs, cfg.Concurrency}, nil
+}
+
+func (s *nsq_source) Start(handler func(*nsq.Message)) error {
+	s.AddConcurrentHandlers(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		msg.DisableAutoResponse()
+		handler(msg)
+		return nil
+	}), s.concurrency)
+
+	// nsqlookupd is polled in background by go-nsq, errors here are permanent
+	for _, addr := range s.nsqlookupds {
+		if err := s.ConnectToNSQLookupd(addr); err != nil {
+			s.Stop()
+			return fmt.Errorf("nsqlookupd %v: %v", addr, err)
+		}
+		log.Info(s.topic, " nsqlookupd connected: ", addr)
+	}
+
+	// direct nsqd connections are retried until succeed
+	for _, addr := range s.nsqds {
+		go s.connect_nsqd(addr)
+	}
+	return nil
+}
+
+func (s *nsq_source) Done() <-chan int { return s.StopChan }
+
+// connect to nsqd with exponential backoff, until succeed or the consumer stops.
+// once connected, go-nsq takes care of reconnecting.
+func (s *nsq_source) connect_nsqd(addr string) {
+	delay := CONNECT_RETRY_MIN
+	for {
+		err := s.ConnectToNSQD(addr)
+		if err == nil || err == nsq.ErrAlreadyConnected {
+			log.Info(s.topic, " nsqd connected: ", addr)
+			return
+		}
+		log.Errorf("connect to nsqd %v: %v, retry in %v", addr, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-s.StopChan:
+			return
+		}
+		if delay *= 2; delay > CONNECT_RETRY_MAX {
+			delay = CONNECT_RETRY_MAX
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	nsq "github.com/bitly/go-nsq"
+	snappy "github.com/mreiferson/go-snappystream/snappy-go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a data change
+type Change struct {
+	Collection string // collection
+	Field      string // field "a.b.c.d"
+	Doc        interface{}
+}
+
+// a redo record represents complete transaction, see nsq-redo
+type RedoRecord struct {
+	API     string   // the api name
+	UID     int32    // userid
+	TS      uint64   // timestamp should get from snowflake
+	Changes []Change // changes
+}
+
+// a rejected message kept in the dead-letter bucket
+type DeadLetter struct {
+	Reason      string // why it's rejected
+	ID          string // nsq message id
+	NSQDAddress string // nsqd the message came from
+	Attempts    uint16 // delivery attempts
+	Timestamp   int64  // nsq message timestamp, in nanoseconds
+	Received    int64  // when the archiver received it, in nanoseconds
+	Body        []byte // the original message
+}
+
+// Envelope wraps a stored record with where and when it's received,
+// the message timestamp set by nsqd lies between the TS set by the
+// producer and the received time, telling clock skew from queue lag
+type Envelope struct {
+	Body        []byte // the original message, a RedoRecord
+	ID          string // nsq message id
+	NSQDAddress string // nsqd the message came from, or the address of another source
+	Attempts    uint16 // delivery attempts
+	Timestamp   int64  // nsq message timestamp, in nanoseconds
+	Received    int64  // when the archiver received it, in nanoseconds
+	Hostname    string // host of the archiver
+}
+
+// the host kept in envelopes
+var _hostname, _ = os.Hostname()
+
+// a message waiting to be committed
+type entry struct {
+	msg      *nsq.Message
+	rec      *RedoRecord // decoded record, nil if rejected
+	reason   string      // why the message is rejected
+	received time.Time
+	// envelope encoded and compressed by prepare, nil if not done ahead
+	envelope   []byte
+	compressed []byte
+}
+
+var (
+	ERR_NO_UID     = errors.New("zero UID")
+	ERR_NO_TS      = errors.New("zero TS")
+	ERR_NO_API     = errors.New("empty API")
+	ERR_NO_CHANGES = errors.New("no changes")
+)
+
+// decode a message body as a RedoRecord and check its invariants
+func validate(body []byte) (*RedoRecord, error) {
+	r := new(RedoRecord)
+	if err := bson.Unmarshal(body, r); err != nil {
+		return nil, err
+	}
+	switch {
+	case r.UID == 0:
+		return nil, ERR_NO_UID
+	case r.TS == 0:
+		return nil, ERR_NO_TS
+	case r.API == "":
+		return nil, ERR_NO_API
+	case len(r.Changes) == 0:
+		return nil, ERR_NO_CHANGES
+	}
+	return r, nil
+}
+
+func new_entry(msg *nsq.Message) *entry {
+	e := &entry{msg: msg, received: time.Now()}
+	rec, err := validate(msg.Body)
+	if err != nil {
+		e.reason = err.Error()
+	} else {
+		e.rec = rec
+	}
+	return e
+}
+
+// prepare the value off the writer goroutine, only the envelope and the
+// compression are done ahead, encryption needs the record key assigned at commit.
+func (e *entry) prepare(compression string) {
+	if e.rec == nil {
+		return
+	}
+	// left to the writer on error
+	envelope, err := e.wrap()
+	if err != nil {
+		return
+	}
+	e.envelope = envelope
+	if compression == COMPRESSION_SNAPPY {
+		e.compressed, _ = snappy.Encode(nil, envelope)
+	}
+}
+
+// the envelope of an entry
+func (e *entry) wrap() ([]byte, error) {
+	return bson.Marshal(&Envelope{
+		Body:        e.msg.Body,
+		ID:          string(e.msg.ID[:]),
+		NSQDAddress: e.msg.NSQDAddress,
+		Attempts:    e.msg.Attempts,
+		Timestamp:   e.msg.Timestamp,
+		Received:    e.received.UnixNano(),
+		Hostname:    _hostname,
+	})
+}
+
+// the dead-letter of a rejected entry
+func (e *entry) dead_letter() ([]byte, error) {
+	return bson.Marshal(&DeadLetter{
+		Reason:      e.reason,
+		ID:          string(e.msg.ID[:]),
+		NSQDAddress: e.msg.NSQDAddress,
+		Attempts:    e.msg.Attempts,
+		Timestamp:   e.msg.Timestamp,
+		Received:    e.received.UnixNano(),
+		Body:        e.msg.Body,
+	})
+}
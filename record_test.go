@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	nsq "github.com/bitly/go-nsq"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestValidate(t *testing.T) {
+	change := []Change{{Collection: "test", Doc: testdoc{"name1", 18}}}
+	cases := []struct {
+		rec interface{}
+		err error
+	}{
+		{RedoRecord{API: "test1", UID: 1, TS: ts(), Changes: change}, nil},
+		{RedoRecord{API: "test1", TS: ts(), Changes: change}, ERR_NO_UID},
+		{RedoRecord{API: "test1", UID: 1, Changes: change}, ERR_NO_TS},
+		{RedoRecord{UID: 1, TS: ts(), Changes: change}, ERR_NO_API},
+		{RedoRecord{API: "test1", UID: 1, TS: ts()}, ERR_NO_CHANGES},
+	}
+	for i, c := range cases {
+		bin, err := bson.Marshal(c.rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := validate(bin); err != c.err {
+			t.Errorf("case %v: expected %v, got %v", i, c.err, err)
+		}
+	}
+
+	if _, err := validate([]byte("garbage")); err == nil {
+		t.Error("garbage should not decode")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := nsq.NewMessage(id, []byte("garbage"))
+	msg.NSQDAddress = "127.0.0.1:4150"
+	msg.Attempts = 2
+
+	e := new_entry(msg)
+	if e.rec != nil || e.reason == "" {
+		t.Fatal("garbage should be rejected")
+	}
+	bin, err := e.dead_letter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := new(DeadLetter)
+	if err := bson.Unmarshal(bin, dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.ID != "0123456789abcdef" || dl.NSQDAddress != msg.NSQDAddress || dl.Attempts != 2 || string(dl.Body) != "garbage" || dl.Reason != e.reason {
+		t.Errorf("unexpected dead letter: %+v", dl)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+	body, _ := bson.Marshal(RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test"}}})
+	msg := nsq.NewMessage(id, body)
+	msg.NSQDAddress = "127.0.0.1:4150"
+	msg.Attempts = 3
+	key := seq_key(1)
+
+	// prepared ahead or by the writer
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_SNAPPY} {
+		for _, prepare := range []bool{true, false} {
+			e := new_entry(msg)
+			if prepare {
+				e.prepare(compression)
+			}
+			v, err := (&codec{compression: compression}).encode_entry(key, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v[0]>>4 != ENVELOPE_VERSION {
+				t.Error("unexpected version", v[0]>>4)
+			}
+			decoded, env, err := decode_record(key, v, nil)
+			if err != nil || !bytes.Equal(decoded, body) {
+				t.Fatal(compression, prepare, "roundtrip failed", err)
+			}
+			if env.ID != "0123456789abcdef" || env.NSQDAddress != msg.NSQDAddress || env.Attempts != 3 ||
+				env.Timestamp != msg.Timestamp || env.Received != e.received.UnixNano() || env.Hostname != _hostname {
+				t.Errorf("unexpected envelope: %+v", env)
+			}
+		}
+	}
+
+	// values written before envelopes
+	v, _ := (&codec{}).encode(key, body)
+	if decoded, env, err := decode_record(key, v, nil); err != nil || env != nil || !bytes.Equal(decoded, body) {
+		t.Error("value without envelope", env, err)
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/yuin/gopher-lua"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"time"
 )
 
 // a data change
@@ -25,6 +25,8 @@ type RedoRecord struct {
 	UID     int32    // userid
 	TS      uint64   // timestamp should get from snowflake
 	Changes []Change // changes
+	// where and when it's received, nil for records archived without
+	Envelope *Envelope `bson:"-" json:",omitempty"`
 }
 
 func (t *ToolBox) builtin_help(L *lua.LState) int {
@@ -35,11 +37,17 @@ func (t *ToolBox) builtin_help(L *lua.LState) int {
 	> help()                                    -- print this text
 	> print(redo:length())                      -- print redolog length
 	> print(redo:get(1))                        -- print a document
+	> redo:uid(1001)                            -- indexes of records of a user
+	> redo:api("login")                         -- indexes of records of an api
+	> redo:collection("items")                  -- indexes of records changing a collection
+	> redo:seek("2016-07-12T14:02:00")          -- index of the first record at or after a time
+	> redo:between("2016-07-12T14:02:00", "2016-07-12T14:05:00") -- indexes of records in a time range
 	> redo:mgo("mongodb://172.17.42.1/mydb")    -- attach to mongodb
 	> redo:replay(1)                            -- replay redolog#1
 	> dofile("/go/scripts/json.lua")            -- require scripts.
 	> tbl = decode(redo:get(1))                 -- convert json to table
 	> print(tbl.TS)                             -- print TS
+	> print(tbl.Envelope.Received - tbl.TS)     -- milliseconds from the producer to the archiver
 	`)
 	return 0
 }
@@ -53,7 +61,12 @@ func (t *ToolBox) builtin_get(L *lua.LState) int {
 				elem := v[idx]
 				r := t.read(idx, elem.db_idx, elem.key)
 				if r != nil {
-					r.TS >>= 22 // keep only millisecond part
+					r.TS >>= TS_SHIFT // keep only millisecond part
+					if r.Envelope != nil {
+						// in milliseconds as well, to compare with TS
+						r.Envelope.Timestamp /= int64(time.Millisecond)
+						r.Envelope.Received /= int64(time.Millisecond)
+					}
 				}
 				bin, _ := json.MarshalIndent(r, "", "\t")
 				L.Push(lua.LString(bin))
@@ -77,6 +90,74 @@ func (t *ToolBox) builtin_length(L *lua.LState) int {
 	return 0
 }
 
+func (t *ToolBox) builtin_uid(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.([]rec); ok {
+		uid := int32(L.CheckInt(2))
+		push_indexes(L, t.lookup(INDEX_UID, uid_prefix(uid), func(r *RedoRecord) bool {
+			return r.UID == uid
+		}))
+		return 1
+	}
+	L.ArgError(1, "invalid userdata")
+	return 0
+}
+
+func (t *ToolBox) builtin_api(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.([]rec); ok {
+		api := L.CheckString(2)
+		push_indexes(L, t.lookup(INDEX_API, str_prefix(api), func(r *RedoRecord) bool {
+			return r.API == api
+		}))
+		return 1
+	}
+	L.ArgError(1, "invalid userdata")
+	return 0
+}
+
+func (t *ToolBox) builtin_collection(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.([]rec); ok {
+		collection := L.CheckString(2)
+		push_indexes(L, t.lookup(INDEX_COLLECTION, str_prefix(collection), func(r *RedoRecord) bool {
+			for k := range r.Changes {
+				if r.Changes[k].Collection == collection {
+					return true
+				}
+			}
+			return false
+		}))
+		return 1
+	}
+	L.ArgError(1, "invalid userdata")
+	return 0
+}
+
+func (t *ToolBox) builtin_seek(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.([]rec); ok {
+		if i := t.seek(check_time(L, 2)); i < 0 {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LNumber(i + 1))
+		}
+		return 1
+	}
+	L.ArgError(1, "invalid userdata")
+	return 0
+}
+
+func (t *ToolBox) builtin_between(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.([]rec); ok {
+		push_indexes(L, t.between(check_time(L, 2), check_time(L, 3), 0))
+		return 1
+	}
+	L.ArgError(1, "invalid userdata")
+	return 0
+}
+
 func (t *ToolBox) builtin_mgo(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	if _, ok := ud.Value.([]rec); ok {
@@ -128,23 +209,7 @@ func (t *ToolBox) builtin_replay(L *lua.LState) int {
 }
 
 func (t *ToolBox) read(idx int, db_idx int, key uint64) *RedoRecord {
-	var r *RedoRecord
-	err := t.dbs[db_idx].View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BOLTDB_BUCKET))
-		k := make([]byte, 8)
-		binary.BigEndian.PutUint64(k, uint64(key))
-		bin := b.Get(k)
-		if bin == nil {
-			return errors.New("record not found")
-		}
-		r = new(RedoRecord)
-		err := bson.Unmarshal(bin, r)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-
+	r, err := t.read_record(db_idx, key)
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -152,6 +217,28 @@ func (t *ToolBox) read(idx int, db_idx int, key uint64) *RedoRecord {
 	return r
 }
 
+func (t *ToolBox) read_record(db_idx int, key uint64) (*RedoRecord, error) {
+	v, err := t.segs[db_idx].Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errors.New("record not found")
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, key)
+	bin, env, err := decode_record(k, v, t.aeads[db_idx])
+	if err != nil {
+		return nil, err
+	}
+	r := new(RedoRecord)
+	if err := bson.Unmarshal(bin, r); err != nil {
+		return nil, err
+	}
+	r.Envelope = env
+	return r, nil
+}
+
 func do_update(r *RedoRecord, sess *mgo.Session) bool {
 	mdb := sess.DB("")
 	for k := range r.Changes {
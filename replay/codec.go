@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	snappy "github.com/mreiferson/go-snappystream/snappy-go"
+	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
+)
+
+// stored record values start with a 1-byte header, the high 4 bits are the
+// format version, the low 4 bits are flags of the encodings applied.
+// new values end with a big endian CRC32C of the header and the payload.
+// values written before the header existed are plain BSON documents.
+const (
+	CODEC_VERSION    = 1      // payload is the BSON document stored
+	ENVELOPE_VERSION = 2      // payload is a BSON Envelope wrapping the record
+	FLAG_SNAPPY      = 1 << 0 // payload is snappy compressed
+	FLAG_AES_GCM     = 1 << 1 // payload is sealed by AES-GCM, prefixed by the nonce, the record key is the additional data
+	FLAG_CRC32C      = 1 << 2 // value ends with the CRC32C of the header and the payload
+	CRC_SIZE         = 4
+)
+
+var (
+	ERR_EMPTY_VALUE     = errors.New("empty value")
+	ERR_UNKNOWN_VERSION = errors.New("unknown value format version")
+	ERR_UNKNOWN_FLAGS   = errors.New("unknown value encoding flags")
+	ERR_NO_KEY          = errors.New("value is encrypted, but no key is given")
+	ERR_CHECKSUM        = errors.New("value CRC32C mismatch")
+)
+
+var crc_table = crc32.MakeTable(crc32.Castagnoli)
+
+// a plain BSON document starts with its own length and ends with 0x00
+func is_bson(v []byte) bool {
+	return len(v) >= 5 && binary.LittleEndian.Uint32(v) == uint32(len(v)) && v[len(v)-1] == 0
+}
+
+// where and when a record is received, written by the archiver along with
+// the record. times are in nanoseconds.
+type Envelope struct {
+	Body        []byte `json:"-"`
+	ID          string // nsq message id
+	NSQDAddress string // nsqd the message came from, or the address of another source
+	Attempts    uint16 // delivery attempts
+	Timestamp   int64  // nsq message timestamp
+	Received    int64  // when the archiver received it
+	Hostname    string // host of the archiver
+}
+
+// decode a value stored at key into the record body and its envelope,
+// nil if it's written without one. aead is needed for encrypted values.
+func decode_record(key, v []byte, aead cipher.AEAD) ([]byte, *Envelope, error) {
+	payload, version, err := open_value(key, v, aead)
+	if err != nil || version != ENVELOPE_VERSION {
+		return payload, nil, err
+	}
+	env := new(Envelope)
+	if err := bson.Unmarshal(payload, env); err != nil {
+		return nil, nil, err
+	}
+	return env.Body, env, nil
+}
+
+// the payload of a value and its format version, 0 for plain BSON
+func open_value(key, v []byte, aead cipher.AEAD) ([]byte, byte, error) {
+	if len(v) == 0 {
+		return nil, 0, ERR_EMPTY_VALUE
+	}
+	if is_bson(v) {
+		return v, 0, nil
+	}
+	version := v[0] >> 4
+	if version != CODEC_VERSION && version != ENVELOPE_VERSION {
+		return nil, 0, fmt.Errorf("%v: %v", ERR_UNKNOWN_VERSION, version)
+	}
+
+	flags := v[0] & 0x0f
+	payload := v[1:]
+	if flags&^(FLAG_SNAPPY|FLAG_AES_GCM|FLAG_CRC32C) != 0 {
+		return nil, 0, fmt.Errorf("%v: %#x", ERR_UNKNOWN_FLAGS, flags)
+	}
+	if flags&FLAG_CRC32C != 0 {
+		if len(v) < 1+CRC_SIZE {
+			return nil, 0, ERR_CHECKSUM
+		}
+		n := len(v) - CRC_SIZE
+		if crc32.Checksum(v[:n], crc_table) != binary.BigEndian.Uint32(v[n:]) {
+			return nil, 0, ERR_CHECKSUM
+		}
+		payload = v[1:n]
+	}
+	if flags&FLAG_AES_GCM != 0 {
+		if aead == nil {
+			return nil, 0, ERR_NO_KEY
+		}
+		if len(payload) < aead.NonceSize() {
+			return nil, 0, errors.New("encrypted value too short")
+		}
+		nonce := payload[:aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, payload[aead.NonceSize():], key)
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = plain
+	}
+	if flags&FLAG_SNAPPY != 0 {
+		decoded, err := snappy.Decode(nil, payload)
+		return decoded, version, err
+	}
+	return payload, version, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"time"
+)
+
+// secondary indexes written by the archiver, keys are prefix+sequence
+const (
+	INDEX_UID        = "IDX_UID"        // uid(4 bytes) + seq
+	INDEX_API        = "IDX_API"        // api + 0x00 + seq
+	INDEX_COLLECTION = "IDX_COLLECTION" // collection + 0x00 + seq
+	INDEX_TS         = "IDX_TS"         // millisecond of TS(8 bytes) + seq
+)
+
+// RedoRecord.TS is a snowflake id, the high bits are milliseconds
+const TS_SHIFT = 22
+
+// millisecond range of the records in a file, from its time index
+type ts_range struct {
+	indexed  bool
+	min, max uint64
+}
+
+func uid_prefix(uid int32) []byte {
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(uid))
+	return prefix
+}
+
+func str_prefix(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// first position in t.recs at or after (db_idx, key), t.recs is sorted by file then key
+func (t *ToolBox) lower_bound(db_idx int, key uint64) int {
+	return sort.Search(len(t.recs), func(i int) bool {
+		r := t.recs[i]
+		return r.db_idx > db_idx || (r.db_idx == db_idx && r.key >= key)
+	})
+}
+
+// position of a record in t.recs, -1 if not loaded
+func (t *ToolBox) index_of(db_idx int, key uint64) int {
+	i := t.lower_bound(db_idx, key)
+	if i < len(t.recs) && t.recs[i].db_idx == db_idx && t.recs[i].key == key {
+		return i
+	}
+	return -1
+}
+
+// find records through an index bucket, files without the index are
+// scanned with match instead. returns positions in t.recs.
+func (t *ToolBox) lookup(index string, prefix []byte, match func(*RedoRecord) bool) []int {
+	var found []int
+	for db_idx, seg := range t.segs {
+		indexed := seg.Scan(index, prefix, func(k []byte) bool {
+			if !bytes.HasPrefix(k, prefix) {
+				return false
+			}
+			if len(k) == len(prefix)+8 {
+				if i := t.index_of(db_idx, binary.BigEndian.Uint64(k[len(prefix):])); i >= 0 {
+					found = append(found, i)
+				}
+			}
+			return true
+		})
+
+		if !indexed {
+			for i := t.lower_bound(db_idx, 0); i < len(t.recs) && t.recs[i].db_idx == db_idx; i++ {
+				if r := t.read(i, db_idx, t.recs[i].key); r != nil && match(r) {
+					found = append(found, i)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// push positions as a lua table of 1-based indexes
+func push_indexes(L *lua.LState, found []int) {
+	tbl := L.NewTable()
+	for _, i := range found {
+		tbl.Append(lua.LNumber(i + 1))
+	}
+	L.Push(tbl)
+}
+
+// load the time range of each file
+func (t *ToolBox) load_ranges() {
+	t.ranges = make([]ts_range, len(t.segs))
+	for i, seg := range t.segs {
+		if first, last := seg.Bounds(INDEX_TS); first != nil {
+			t.ranges[i] = ts_range{true, binary.BigEndian.Uint64(first), binary.BigEndian.Uint64(last)}
+		}
+	}
+}
+
+// positions of records with a millisecond timestamp within [from, to], in
+// time order within each file, at most limit records if limit > 0.
+// TS comes from the producers' clocks, so the time ranges of files may
+// overlap and aren't in file order, each file is checked by its own range.
+func (t *ToolBox) between(from, to uint64, limit int) []int {
+	var found []int
+	for db_idx := range t.segs {
+		if limit > 0 && len(found) >= limit {
+			break
+		}
+		r := t.ranges[db_idx]
+		if !r.indexed {
+			// written before the time index or without indexes, decode all
+			for i := t.lower_bound(db_idx, 0); i < len(t.recs) && t.recs[i].db_idx == db_idx; i++ {
+				if limit > 0 && len(found) >= limit {
+					break
+				}
+				if rec := t.read(i, db_idx, t.recs[i].key); rec != nil {
+					if ms := rec.TS >> TS_SHIFT; ms >= from && ms <= to {
+						found = append(found, i)
+					}
+				}
+			}
+			continue
+		}
+		if r.min > to || r.max < from {
+			continue
+		}
+
+		prefix := make([]byte, 8)
+		binary.BigEndian.PutUint64(prefix, from)
+		t.segs[db_idx].Scan(INDEX_TS, prefix, func(k []byte) bool {
+			if len(k) != 16 || binary.BigEndian.Uint64(k) > to || (limit > 0 && len(found) >= limit) {
+				return false
+			}
+			if i := t.index_of(db_idx, binary.BigEndian.Uint64(k[8:])); i >= 0 {
+				found = append(found, i)
+			}
+			return true
+		})
+	}
+	return found
+}
+
+// position of the earliest record at or after from, -1 if there's none.
+// the time ranges of files overlap, so the earliest of each file is compared,
+// the earlier file wins a tie.
+func (t *ToolBox) seek(from uint64) int {
+	found, found_ms := -1, uint64(0)
+	for db_idx := range t.segs {
+		if i, ms := t.first_after(db_idx, from); i >= 0 && (found < 0 || ms < found_ms) {
+			found, found_ms = i, ms
+		}
+	}
+	return found
+}
+
+// the earliest record of a file at or after from and its millisecond
+func (t *ToolBox) first_after(db_idx int, from uint64) (found int, ms uint64) {
+	found = -1
+	r := t.ranges[db_idx]
+	if !r.indexed {
+		for i := t.lower_bound(db_idx, 0); i < len(t.recs) && t.recs[i].db_idx == db_idx; i++ {
+			if rec := t.read(i, db_idx, t.recs[i].key); rec != nil {
+				if m := rec.TS >> TS_SHIFT; m >= from && (found < 0 || m < ms) {
+					found, ms = i, m
+				}
+			}
+		}
+		return found, ms
+	}
+	if r.max < from {
+		return found, ms
+	}
+
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, from)
+	t.segs[db_idx].Scan(INDEX_TS, prefix, func(k []byte) bool {
+		if len(k) != 16 {
+			return false
+		}
+		if i := t.index_of(db_idx, binary.BigEndian.Uint64(k[8:])); i >= 0 {
+			found, ms = i, binary.BigEndian.Uint64(k)
+			return false
+		}
+		return true
+	})
+	return found, ms
+}
+
+// a time argument, either milliseconds since epoch or a local time string in LAYOUT
+func check_time(L *lua.LState, n int) uint64 {
+	switch v := L.CheckAny(n).(type) {
+	case lua.LNumber:
+		return uint64(v)
+	case lua.LString:
+		tm, err := time.ParseInLocation(LAYOUT, string(v), time.Local)
+		if err != nil {
+			L.ArgError(n, err.Error())
+			return 0
+		}
+		return uint64(tm.UnixNano() / int64(time.Millisecond))
+	}
+	L.ArgError(n, "expect milliseconds or "+LAYOUT)
+	return 0
+}
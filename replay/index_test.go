@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// records in memory, the millisecond of record seq at ms[seq-1]
+type test_segment struct {
+	ms      []uint64
+	indexed bool
+}
+
+type test_index [][]byte
+
+func (a test_index) Len() int           { return len(a) }
+func (a test_index) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a test_index) Less(i, j int) bool { return bytes.Compare(a[i], a[j]) < 0 }
+
+func (s *test_segment) Keys() ([]uint64, error) {
+	var keys []uint64
+	for i := range s.ms {
+		keys = append(keys, uint64(i+1))
+	}
+	return keys, nil
+}
+
+func (s *test_segment) Get(seq uint64) ([]byte, error) {
+	if seq == 0 || seq > uint64(len(s.ms)) {
+		return nil, nil
+	}
+	ms := s.ms[seq-1]
+	return bson.Marshal(RedoRecord{API: "test", UID: 1, TS: ms << TS_SHIFT})
+}
+
+func (s *test_segment) KeyID() string { return "" }
+func (s *test_segment) Close() error  { return nil }
+
+func (s *test_segment) index() test_index {
+	var keys test_index
+	for i, ms := range s.ms {
+		k := make([]byte, 16)
+		binary.BigEndian.PutUint64(k, ms)
+		binary.BigEndian.PutUint64(k[8:], uint64(i+1))
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	return keys
+}
+
+func (s *test_segment) Scan(index string, seek []byte, fn func(k []byte) bool) bool {
+	if !s.indexed {
+		return false
+	}
+	for _, k := range s.index() {
+		if bytes.Compare(k, seek) >= 0 && !fn(k) {
+			break
+		}
+	}
+	return true
+}
+
+func (s *test_segment) Bounds(index string) (first, last []byte) {
+	if keys := s.index(); s.indexed && len(keys) > 0 {
+		return keys[0], keys[len(keys)-1]
+	}
+	return nil, nil
+}
+
+func test_toolbox(segs ...Segment) *ToolBox {
+	t := &ToolBox{segs: segs, aeads: make([]cipher.AEAD, len(segs))}
+	for db_idx, seg := range segs {
+		keys, _ := seg.Keys()
+		for _, key := range keys {
+			t.recs = append(t.recs, rec{db_idx, key})
+		}
+	}
+	t.load_ranges()
+	return t
+}
+
+func TestSeekOverlap(t *testing.T) {
+	// the second file starts before the first one ends
+	for _, indexed := range []bool{true, false} {
+		a := &test_segment{[]uint64{100, 200, 300}, indexed}
+		b := &test_segment{[]uint64{150, 250}, indexed}
+		tb := test_toolbox(a, b)
+		cases := []struct {
+			from uint64
+			pos  int
+		}{
+			{0, 0}, {120, 3}, {150, 3}, {160, 1}, {220, 4}, {260, 2}, {301, -1},
+		}
+		for _, c := range cases {
+			if pos := tb.seek(c.from); pos != c.pos {
+				t.Error("indexed", indexed, "seek", c.from, "got", pos, "want", c.pos)
+			}
+		}
+	}
+}
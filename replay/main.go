@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"github.com/yuin/gopher-lua"
 	"github.com/yuin/gopher-lua/parse"
 	"gopkg.in/readline.v1"
 	"log"
+	"path/filepath"
 )
 
 const (
@@ -18,10 +20,10 @@ type REPL struct {
 	reader  *readline.Instance
 }
 
-func NewREPL() *REPL {
+func NewREPL(dir, bucket string, verify bool, keyring *Keyring) *REPL {
 	r := new(REPL)
 	r.L = lua.NewState()
-	r.toolbox = NewToolBox("/data")
+	r.toolbox = NewToolBox(dir, bucket, verify, keyring)
 	if reader, err := readline.New(PS1); err == nil {
 		r.reader = reader
 	} else {
@@ -89,7 +91,22 @@ func (r *REPL) multiline(ml string) (string, error) {
 }
 
 func main() {
-	r := NewREPL()
+	dir := flag.String("dir", "/data", "data directory of the archiver")
+	topic := flag.String("topic", "REDOLOG", "topic to load, archives of each topic are in dir/topic, empty to load dir itself")
+	bucket := flag.String("bucket", BOLTDB_BUCKET, "boltdb bucket of records")
+	verify := flag.Bool("verify", false, "verify sealed files against the checksum in their manifest")
+	key_file := flag.String("key-file", "", "key file to decrypt encrypted archives, \"<id> <hex key>\" per line")
+	flag.Parse()
+
+	var keyring *Keyring
+	if *key_file != "" {
+		k, err := load_keyring(*key_file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyring = k
+	}
+	r := NewREPL(filepath.Join(*dir, *topic), *bucket, *verify, keyring)
 	r.Start()
 	r.Close()
 }
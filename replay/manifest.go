@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const MANIFEST_SUFFIX = ".manifest"
+
+// written by the archiver next to each sealed RDO file
+type Manifest struct {
+	File    string `json:"file"`
+	Records uint64 `json:"records"`
+	MinTS   uint64 `json:"min_ts"`
+	MaxTS   uint64 `json:"max_ts"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// the manifest of a RDO file, nil if it's not sealed
+func read_manifest(file string) (*Manifest, error) {
+	bts, err := ioutil.ReadFile(file + MANIFEST_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(bts, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// check the size and checksum of a sealed file
+func (m *Manifest) verify(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return err == nil && n == m.Size && hex.EncodeToString(h.Sum(nil)) == m.SHA256
+}
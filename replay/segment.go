@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// segment files written by the archiver with -storage segment:
+//
+//	header: magic(8) | meta length(4) | meta json | crc32c(4)
+//	frame:  kind(1) | seq(8) | ts(8) | value length(4) | hash length(1) | value | hash | crc32c(4)
+//
+// a sealed file ends with an index frame, they have no secondary indexes.
+const (
+	SEGMENT_MAGIC     = "RDOSEG\x00\x01"
+	FRAME_RECORD      = 1
+	FRAME_INDEX       = 3
+	FRAME_HEADER_SIZE = 22
+)
+
+var ERR_FRAME_CHECKSUM = errors.New("frame CRC32C mismatch")
+
+// a segment opened read-only, the offsets of its records are loaded by a
+// scan of the frame headers
+type append_segment struct {
+	f      *os.File
+	key_id string
+	seqs   []uint64
+	offs   []int64
+}
+
+func open_append_segment(file string) (Segment, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &append_segment{f: f}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *append_segment) load() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	head := make([]byte, len(SEGMENT_MAGIC)+4)
+	if _, err := s.f.ReadAt(head, 0); err != nil {
+		return err
+	}
+	n := int64(binary.BigEndian.Uint32(head[len(SEGMENT_MAGIC):]))
+	if int64(len(head))+n+CRC_SIZE > size {
+		return errors.New("invalid segment header")
+	}
+	meta := make([]byte, n)
+	if _, err := s.f.ReadAt(meta, int64(len(head))); err != nil {
+		return err
+	}
+	var m struct {
+		KeyID string `json:"key_id"`
+	}
+	if err := json.Unmarshal(meta, &m); err != nil {
+		return err
+	}
+	s.key_id = m.KeyID
+
+	// a torn frame at the end is ignored
+	fh := make([]byte, FRAME_HEADER_SIZE)
+	for off := int64(len(head)) + n + CRC_SIZE; off+FRAME_HEADER_SIZE <= size; {
+		if _, err := s.f.ReadAt(fh, off); err != nil {
+			return err
+		}
+		next := off + FRAME_HEADER_SIZE + int64(binary.BigEndian.Uint32(fh[17:])) + int64(fh[21]) + CRC_SIZE
+		if fh[0] == FRAME_INDEX || next > size {
+			break
+		}
+		if fh[0] == FRAME_RECORD {
+			s.seqs = append(s.seqs, binary.BigEndian.Uint64(fh[1:]))
+			s.offs = append(s.offs, off)
+		}
+		off = next
+	}
+	return nil
+}
+
+func (s *append_segment) Keys() ([]uint64, error) { return s.seqs, nil }
+func (s *append_segment) KeyID() string           { return s.key_id }
+func (s *append_segment) Close() error            { return s.f.Close() }
+
+// no secondary indexes, lookups scan the records
+func (s *append_segment) Scan(string, []byte, func([]byte) bool) bool { return false }
+func (s *append_segment) Bounds(string) (first, last []byte)          { return nil, nil }
+
+func (s *append_segment) Get(seq uint64) ([]byte, error) {
+	i := sort.Search(len(s.seqs), func(i int) bool { return s.seqs[i] >= seq })
+	if i == len(s.seqs) || s.seqs[i] != seq {
+		return nil, nil
+	}
+	fh := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := s.f.ReadAt(fh, s.offs[i]); err != nil {
+		return nil, err
+	}
+	vlen := int64(binary.BigEndian.Uint32(fh[17:]))
+	buf := make([]byte, FRAME_HEADER_SIZE+vlen+int64(fh[21])+CRC_SIZE)
+	if _, err := s.f.ReadAt(buf, s.offs[i]); err != nil && err != io.EOF {
+		return nil, err
+	}
+	n := len(buf) - CRC_SIZE
+	if crc32.Checksum(buf[:n], crc_table) != binary.BigEndian.Uint32(buf[n:]) {
+		return nil, ERR_FRAME_CHECKSUM
+	}
+	return buf[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+vlen], nil
+}
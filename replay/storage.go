@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// a RDO file opened read-only, a bolt file or an append-only segment
+// written by the archiver, recognised by its content
+type Segment interface {
+	Keys() ([]uint64, error)        // record sequences in order
+	Get(seq uint64) ([]byte, error) // stored value of a record, nil if not found
+	KeyID() string                  // id of the key encrypting the file
+	// keys of an index from seek on, until fn returns false.
+	// returns false if the file has no such index.
+	Scan(index string, seek []byte, fn func(k []byte) bool) bool
+	Bounds(index string) (first, last []byte) // first and last keys of an index
+	Close() error
+}
+
+func open_segment(file, bucket string) (Segment, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(SEGMENT_MAGIC))
+	_, err = io.ReadFull(f, magic)
+	f.Close()
+	if err == nil && bytes.Equal(magic, []byte(SEGMENT_MAGIC)) {
+		return open_append_segment(file)
+	}
+
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 2 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &bolt_segment{db, bucket}, nil
+}
+
+// open a RDO file, or its snapshot if the file is locked by the archiver
+// writing it. a snapshot left by a stopped archiver is stale, the file is
+// preferred whenever it can be opened.
+func open_rdo(file, bucket string) (Segment, error) {
+	seg, err := open_segment(file, bucket)
+	if err != bolt.ErrTimeout {
+		return seg, err
+	}
+	snapshot := file + SNAPSHOT_SUFFIX
+	if _, e := os.Stat(snapshot); e != nil {
+		return nil, err
+	}
+	log.Println(file, "is locked, load", snapshot)
+	return open_segment(snapshot, bucket)
+}
+
+type bolt_segment struct {
+	*bolt.DB
+	bucket string
+}
+
+func (s *bolt_segment) Keys() (keys []uint64, err error) {
+	err = s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return
+}
+
+func (s *bolt_segment) Get(seq uint64) (v []byte, err error) {
+	err = s.View(func(tx *bolt.Tx) error {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+		if b := tx.Bucket([]byte(s.bucket)); b != nil {
+			if val := b.Get(k); val != nil {
+				v = append([]byte(nil), val...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (s *bolt_segment) KeyID() (key_id string) {
+	s.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(META_BUCKET)); b != nil {
+			key_id = string(b.Get([]byte(META_KEY_ID)))
+		}
+		return nil
+	})
+	return
+}
+
+func (s *bolt_segment) Scan(index string, seek []byte, fn func(k []byte) bool) (indexed bool) {
+	s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(index))
+		if b == nil {
+			return nil
+		}
+		indexed = true
+		c := b.Cursor()
+		k, _ := c.First()
+		if seek != nil {
+			k, _ = c.Seek(seek)
+		}
+		for ; k != nil && fn(k); k, _ = c.Next() {
+		}
+		return nil
+	})
+	return
+}
+
+func (s *bolt_segment) Bounds(index string) (first, last []byte) {
+	s.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(index)); b != nil {
+			c := b.Cursor()
+			k, _ := c.First()
+			first = append([]byte(nil), k...)
+			k, _ = c.Last()
+			last = append([]byte(nil), k...)
+		}
+		return nil
+	})
+	if len(first) == 0 {
+		first, last = nil, nil
+	}
+	return
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"encoding/binary"
+	"crypto/cipher"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/yuin/gopher-lua"
 	"gopkg.in/mgo.v2"
 	"log"
@@ -13,8 +12,11 @@ import (
 )
 
 const (
-	BOLTDB_BUCKET = "REDOLOG"
-	LAYOUT        = "2006-01-02T15:04:05"
+	BOLTDB_BUCKET   = "REDOLOG"
+	META_BUCKET     = "META"
+	META_KEY_ID     = "key_id"    // id of the key encrypting the file
+	SNAPSHOT_SUFFIX = ".snapshot" // consistent copy of a file being written
+	LAYOUT          = "2006-01-02T15:04:05"
 )
 
 type rec struct {
@@ -23,9 +25,12 @@ type rec struct {
 }
 
 type ToolBox struct {
-	L       *lua.LState // the lua virtual machine
-	dbs     []*bolt.DB  // all opened boltdb
+	L       *lua.LState   // the lua virtual machine
+	segs    []Segment     // all opened files
+	aeads   []cipher.AEAD // key of each db, nil if not encrypted
 	recs    []rec
+	ranges  []ts_range // time range of each file
+	bucket  string
 	mgo     *mgo.Session
 	mgo_url string
 }
@@ -36,45 +41,62 @@ func (a file_sort) Len() int      { return len(a) }
 func (a file_sort) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a file_sort) Less(i, j int) bool {
 	layout := "REDO-2006-01-02T15:04:05.RDO"
-	tm_a, _ := time.Parse(layout, a[i])
-	tm_b, _ := time.Parse(layout, a[j])
+	tm_a, _ := time.Parse(layout, filepath.Base(a[i]))
+	tm_b, _ := time.Parse(layout, filepath.Base(a[j]))
 	return tm_a.Unix() < tm_b.Unix()
 }
 
-func NewToolBox(dir string) *ToolBox {
+func NewToolBox(dir, bucket string, verify bool, keyring *Keyring) *ToolBox {
 	t := new(ToolBox)
+	t.bucket = bucket
 	// lookup *.RDO
-	files, err := filepath.Glob(dir + "/*.RDO")
+	files, err := load_list(dir)
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
-	// sort by creation time
-	sort.Sort(file_sort(files))
 
-	// open all db
+	// open all files, sealed files are checked against their manifest
 	for _, file := range files {
-		db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 2 * time.Second, ReadOnly: true})
+		m, err := read_manifest(file)
 		if err != nil {
-			log.Println(err)
+			log.Println(file, err)
+		} else if m != nil && m.Records == 0 {
+			continue
+		} else if m != nil && verify && !m.verify(file) {
+			log.Println(file, "checksum mismatch, skipped")
+			continue
+		}
+
+		seg, err := open_rdo(file, bucket)
+		if err != nil {
+			log.Println(file, err)
 			continue
 		}
-		t.dbs = append(t.dbs, db)
+		aead, err := file_key(seg, keyring)
+		if err != nil {
+			log.Println(file, err, "skipped")
+			seg.Close()
+			continue
+		}
+		t.segs = append(t.segs, seg)
+		t.aeads = append(t.aeads, aead)
 	}
 
 	// reindex all keys
 	log.Println("loading database")
-	for i := range t.dbs {
-		t.dbs[i].View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(BOLTDB_BUCKET))
-			c := b.Cursor()
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				t.recs = append(t.recs, rec{i, binary.BigEndian.Uint64(k)})
-			}
-			return nil
-		})
+	for i, seg := range t.segs {
+		keys, err := seg.Keys()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, key := range keys {
+			t.recs = append(t.recs, rec{i, key})
+		}
 	}
 
+	t.load_ranges()
+
 	// init lua machine
 	log.Println("init lua machine")
 	t.L = lua.NewState()
@@ -86,10 +108,33 @@ func NewToolBox(dir string) *ToolBox {
 	return t
 }
 
+// the key encrypting a file, nil if it's not encrypted
+func file_key(seg Segment, keyring *Keyring) (aead cipher.AEAD, err error) {
+	key_id := seg.KeyID()
+	if key_id == "" {
+		return nil, nil
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("is encrypted with key %q, use -key-file", key_id)
+	}
+	return keyring.aead(key_id)
+}
+
+// RDO files to load in order
+func load_list(dir string) ([]string, error) {
+	files, err := filepath.Glob(dir + "/*.RDO")
+	if err != nil {
+		return nil, err
+	}
+	// sort by creation time
+	sort.Sort(file_sort(files))
+	return files, nil
+}
+
 func (t *ToolBox) Close() {
 	t.L.Close()
-	for _, db := range t.dbs {
-		db.Close()
+	for _, seg := range t.segs {
+		seg.Close()
 	}
 	if t.mgo != nil {
 		t.mgo.Close()
@@ -100,10 +145,15 @@ func (t *ToolBox) register() {
 	mt := t.L.NewTypeMetatable("mt_reclist")
 	t.L.SetGlobal("mt_reclist", mt)
 	t.L.SetField(mt, "__index", t.L.SetFuncs(t.L.NewTable(), map[string]lua.LGFunction{
-		"get":    t.builtin_get,
-		"length": t.builtin_length,
-		"mgo":    t.builtin_mgo,
-		"replay": t.builtin_replay,
+		"get":        t.builtin_get,
+		"length":     t.builtin_length,
+		"mgo":        t.builtin_mgo,
+		"replay":     t.builtin_replay,
+		"uid":        t.builtin_uid,
+		"api":        t.builtin_api,
+		"collection": t.builtin_collection,
+		"seek":       t.builtin_seek,
+		"between":    t.builtin_between,
 	}))
 
 	Int64(0).register(t.L)
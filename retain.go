@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	snappystream "github.com/mreiferson/go-snappystream"
+)
+
+const (
+	RETAIN_INTERVAL = time.Hour
+	SNAPPY_SUFFIX   = ".sz" // cold files compressed in snappy framing format
+	RETAIN_MOVE     = "move"
+	RETAIN_DELETE   = "delete"
+)
+
+// RetainPolicy decides which RDO files of a topic are moved to the cold
+// directory or deleted. only sealed files are touched, the file being
+// written is never sealed.
+type RetainPolicy struct {
+	Hot      time.Duration // files older than Hot are moved to ColdDir, 0 to keep all hot
+	ColdDir  string        // cold directory of the topic, empty for no cold tier
+	Compress bool          // snappy compress files moved to ColdDir
+	MaxAge   time.Duration // files older than MaxAge are deleted, 0 to keep forever
+	MaxSize  int64         // oldest files are deleted while the topic is larger, 0 for no limit
+	DryRun   bool          // only log the actions
+}
+
+// RetainAction is a move or delete decided by the policy
+type RetainAction struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// a RDO file under retention
+type retained struct {
+	file    string
+	created time.Time
+	size    int64
+	sealed  bool
+	cold    bool
+}
+
+type by_created []retained
+
+func (a by_created) Len() int           { return len(a) }
+func (a by_created) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a by_created) Less(i, j int) bool { return a[i].created.Before(a[j].created) }
+
+func (p *RetainPolicy) enabled() bool {
+	return p.Hot > 0 || p.MaxAge > 0 || p.MaxSize > 0
+}
+
+// the RDO file name of a cold file
+func rdo_name(file string) string {
+	return strings.TrimSuffix(file, SNAPPY_SUFFIX)
+}
+
+// list the RDO files in dir, oldest first
+func list_retained(dir string, cold bool) ([]retained, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.RDO"))
+	if err != nil {
+		return nil, err
+	}
+	if cold {
+		compressed, err := filepath.Glob(filepath.Join(dir, "*.RDO"+SNAPPY_SUFFIX))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, compressed...)
+	}
+
+	var rs []retained
+	for _, file := range files {
+		created, err := time.ParseInLocation(REDO_TIME_FORMAT, filepath.Base(rdo_name(file)), time.Local)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(manifest_path(rdo_name(file)))
+		rs = append(rs, retained{file, created, fi.Size(), err == nil, cold})
+	}
+	sort.Stable(by_created(rs))
+	return rs, nil
+}
+
+// decide the actions on files at now, files are sorted oldest first
+func (p *RetainPolicy) plan(files []retained, now time.Time) []RetainAction {
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	actions := make([]*RetainAction, len(files))
+	for i, f := range files {
+		if !f.sealed {
+			continue
+		}
+		age := now.Sub(f.created)
+		if p.MaxAge > 0 && age > p.MaxAge {
+			actions[i] = &RetainAction{Action: RETAIN_DELETE, File: f.file, Reason: fmt.Sprintf("older than %v", p.MaxAge)}
+			total -= f.size
+		} else if !f.cold && p.ColdDir != "" && p.Hot > 0 && age > p.Hot {
+			to := filepath.Join(p.ColdDir, filepath.Base(f.file))
+			if p.Compress {
+				to += SNAPPY_SUFFIX
+			}
+			actions[i] = &RetainAction{Action: RETAIN_MOVE, File: f.file, To: to, Reason: fmt.Sprintf("older than %v", p.Hot)}
+		}
+	}
+
+	// oldest files go first when over budget
+	for i, f := range files {
+		if p.MaxSize <= 0 || total <= p.MaxSize {
+			break
+		}
+		if !f.sealed || actions[i] != nil && actions[i].Action == RETAIN_DELETE {
+			continue
+		}
+		actions[i] = &RetainAction{Action: RETAIN_DELETE, File: f.file, Reason: fmt.Sprintf("over size budget %v", p.MaxSize)}
+		total -= f.size
+	}
+
+	var plan []RetainAction
+	for _, a := range actions {
+		if a != nil {
+			a.DryRun = p.DryRun
+			plan = append(plan, *a)
+		}
+	}
+	return plan
+}
+
+// apply the policy to the RDO files in dir, each action is logged
+func (p *RetainPolicy) run(dir string, now time.Time) ([]RetainAction, error) {
+	files, err := list_retained(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if p.ColdDir != "" {
+		cold, err := list_retained(p.ColdDir, true)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		files = append(files, cold...)
+		sort.Stable(by_created(files))
+	}
+
+	plan := p.plan(files, now)
+	for i := range plan {
+		a := &plan[i]
+		if a.DryRun {
+			log.Infof("retain dry-run: %v %v %v (%v)", a.Action, a.File, a.To, a.Reason)
+			continue
+		}
+		if err := p.apply(a); err != nil {
+			a.Error = err.Error()
+			log.Errorf("retain: %v %v %v: %v", a.Action, a.File, a.To, err)
+			continue
+		}
+		log.Infof("retain: %v %v %v (%v)", a.Action, a.File, a.To, a.Reason)
+	}
+	return plan, nil
+}
+
+func (p *RetainPolicy) apply(a *RetainAction) error {
+	switch a.Action {
+	case RETAIN_MOVE:
+		if err := os.MkdirAll(p.ColdDir, 0755); err != nil {
+			return err
+		}
+		if err := copy_file(a.File, a.To, p.Compress); err != nil {
+			return err
+		}
+		if err := copy_file(manifest_path(a.File), manifest_path(rdo_name(a.To)), false); err != nil {
+			return err
+		}
+	case RETAIN_DELETE:
+	default:
+		return fmt.Errorf("unknown action %q", a.Action)
+	}
+
+	// the file goes before its manifest, a file without manifest would be sealed again
+	if err := os.Remove(a.File); err != nil {
+		return err
+	}
+	return os.Remove(manifest_path(rdo_name(a.File)))
+}
+
+// copy a sealed file, optionally snappy compressed, the copy is synced
+// and renamed into place
+func copy_file(src, dst string, compress bool) error {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	tmp := dst + COMPACT_SUFFIX
+	to, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if compress {
+		w := snappystream.NewBufferedWriter(to)
+		_, err = io.Copy(w, from)
+		if err == nil {
+			err = w.Close() // flushes only, to is closed below
+		}
+	} else {
+		_, err = io.Copy(to, from)
+	}
+	if err == nil {
+		err = to.Sync()
+	}
+	if e := to.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmp, SEALED_MODE)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// apply the retention policy once to every topic under the data dir, each
+// action is written to w as a line of json. returns false if any action failed.
+func retain_data(cfg *Config, w io.Writer) (bool, error) {
+	dirs, err := ioutil.ReadDir(cfg.DataDir)
+	if err != nil {
+		return false, err
+	}
+	enc := json.NewEncoder(w)
+	ok := true
+	for _, fi := range dirs {
+		if !fi.IsDir() {
+			continue
+		}
+		plan, err := cfg.retain_policy(fi.Name()).run(filepath.Join(cfg.DataDir, fi.Name()), time.Now())
+		if err != nil {
+			return false, err
+		}
+		for _, a := range plan {
+			if err := enc.Encode(a); err != nil {
+				return false, err
+			}
+			ok = ok && a.Error == ""
+		}
+	}
+	return ok, nil
+}
+
+// apply the retention policy to the topic periodically
+func (arch *Archiver) retain_task() {
+	p := arch.cfg.retain_policy(arch.topic)
+	ticker := time.NewTicker(RETAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if _, err := p.run(arch.dir, time.Now()); err != nil {
+			log.Error(arch.topic, " retain: ", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-arch.source.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	snappystream "github.com/mreiferson/go-snappystream"
+)
+
+func TestRetainPlan(t *testing.T) {
+	now := time.Date(2016, 7, 12, 0, 0, 0, 0, time.UTC)
+	day := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	files := []retained{
+		{file: "cold/5", created: day(5), size: 10, sealed: true, cold: true},
+		{file: "hot/4", created: day(4), size: 10, sealed: true},
+		{file: "hot/3", created: day(3), size: 10, sealed: false}, // left unsealed by a crash
+		{file: "hot/2", created: day(2), size: 10, sealed: true},
+		{file: "hot/1", created: day(1), size: 10, sealed: true},
+		{file: "hot/0", created: day(0), size: 10, sealed: false}, // being written
+	}
+
+	p := &RetainPolicy{Hot: 36 * time.Hour, ColdDir: "cold", Compress: true, MaxAge: 108 * time.Hour, MaxSize: 40}
+	plan := p.plan(files, now)
+	expect := []RetainAction{
+		{Action: RETAIN_DELETE, File: "cold/5"},               // too old
+		{Action: RETAIN_DELETE, File: "hot/4"},                // over budget
+		{Action: RETAIN_MOVE, File: "hot/2", To: "cold/2.sz"}, // not hot any more
+	}
+	if len(plan) != len(expect) {
+		t.Fatalf("expect %v actions, got %+v", len(expect), plan)
+	}
+	for i, a := range plan {
+		if a.Action != expect[i].Action || a.File != expect[i].File || a.To != expect[i].To {
+			t.Errorf("expect %+v, got %+v", expect[i], a)
+		}
+	}
+
+	// unsealed files are counted in the budget, but never touched
+	p = &RetainPolicy{MaxSize: 1}
+	for _, a := range p.plan(files, now) {
+		if a.File == "hot/3" || a.File == "hot/0" {
+			t.Error("unsealed file touched:", a)
+		}
+	}
+}
+
+func TestRetainRun(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	cold, err := ioutil.TempDir("", "cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cold)
+
+	// a sealed file of two days ago and the current one
+	created := time.Now().Add(-48 * time.Hour)
+	old := filepath.Join(arch.dir, created.Format(REDO_TIME_FORMAT))
+	rl, err := arch.new_redolog(old, created, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+	if _, err := arch.seal(old, created); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(old)
+	rl = test_open(t, arch)
+	defer rl.Close()
+
+	p := &RetainPolicy{Hot: 24 * time.Hour, ColdDir: cold, Compress: true, DryRun: true}
+	if plan, err := p.run(arch.dir, time.Now()); err != nil || len(plan) != 1 {
+		t.Fatal("unexpected plan", plan, err)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatal("dry run moved the file", err)
+	}
+
+	p.DryRun = false
+	if plan, err := p.run(arch.dir, time.Now()); err != nil || len(plan) != 1 || plan[0].Error != "" {
+		t.Fatal("move failed", plan, err)
+	}
+	for _, file := range []string{old, manifest_path(old)} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Error("file left in hot dir:", file)
+		}
+	}
+	if _, err := os.Stat(rl.file); err != nil {
+		t.Error("current file touched", err)
+	}
+	moved := filepath.Join(cold, filepath.Base(old))
+	if m, err := read_manifest(moved); err != nil || m == nil {
+		t.Error("manifest not moved", err)
+	}
+	f, err := os.Open(moved + SNAPPY_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if bts, err := ioutil.ReadAll(snappystream.NewReader(f, true)); err != nil || !bytes.Equal(bts, content) {
+		t.Error("cold file differs", err)
+	}
+}
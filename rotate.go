@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	ALIGN_NONE = ""
+	ALIGN_HOUR = "hour"
+	ALIGN_DAY  = "day"
+)
+
+// RotatePolicy decides when the current redolog should be sealed and a new
+// one started, any trigger that fires first wins, a zero value disables it.
+type RotatePolicy struct {
+	Interval   time.Duration  // maximum lifetime of a file, counted from its creation
+	Align      string         // rotate on wall-clock boundaries: "hour" or "day"
+	Location   *time.Location // timezone of the wall-clock boundaries
+	MaxSize    int64          // maximum file size in bytes
+	MaxRecords uint64         // maximum records in a file
+}
+
+// deadline returns the time a file created at t must be rotated,
+// the zero time means the file never expires.
+func (p *RotatePolicy) deadline(t time.Time) time.Time {
+	var deadline time.Time
+	if p.Interval > 0 {
+		deadline = t.Add(p.Interval)
+	}
+
+	loc := p.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	var boundary time.Time
+	y, m, d := t.In(loc).Date()
+	switch p.Align {
+	case ALIGN_DAY:
+		boundary = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	case ALIGN_HOUR:
+		boundary = time.Date(y, m, d, t.In(loc).Hour()+1, 0, 0, 0, loc)
+	}
+
+	if !boundary.IsZero() && (deadline.IsZero() || boundary.Before(deadline)) {
+		deadline = boundary
+	}
+	return deadline
+}
+
+// expired checks whether a file created at t must be rotated by now
+func (p *RotatePolicy) expired(t time.Time, now time.Time) bool {
+	deadline := p.deadline(t)
+	return !deadline.IsZero() && !now.Before(deadline)
+}
+
+// full checks whether a file has reached its size or record limit
+func (p *RotatePolicy) full(size int64, records uint64) bool {
+	if p.MaxSize > 0 && size >= p.MaxSize {
+		return true
+	}
+	if p.MaxRecords > 0 && records >= p.MaxRecords {
+		return true
+	}
+	return false
+}
+
+// timer fires at the deadline of a file created at t, never if there's none
+func (p *RotatePolicy) timer(t time.Time) <-chan time.Time {
+	deadline := p.deadline(t)
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.After(deadline.Sub(time.Now()))
+}
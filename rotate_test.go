@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotateDeadline(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	created := time.Date(2016, 7, 12, 15, 4, 5, 0, time.UTC)
+	cases := []struct {
+		policy   RotatePolicy
+		deadline time.Time
+	}{
+		{RotatePolicy{}, time.Time{}},
+		{RotatePolicy{Interval: 24 * time.Hour}, created.Add(24 * time.Hour)},
+		{RotatePolicy{Align: ALIGN_DAY}, time.Date(2016, 7, 13, 0, 0, 0, 0, time.UTC)},
+		{RotatePolicy{Align: ALIGN_HOUR}, time.Date(2016, 7, 12, 16, 0, 0, 0, time.UTC)},
+		{RotatePolicy{Align: ALIGN_DAY, Location: shanghai}, time.Date(2016, 7, 13, 0, 0, 0, 0, shanghai)},
+		{RotatePolicy{Interval: time.Hour, Align: ALIGN_DAY}, created.Add(time.Hour)},
+		{RotatePolicy{Interval: 48 * time.Hour, Align: ALIGN_DAY}, time.Date(2016, 7, 13, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for i, c := range cases {
+		if deadline := c.policy.deadline(created); !deadline.Equal(c.deadline) {
+			t.Errorf("case %v: expected %v, got %v", i, c.deadline, deadline)
+		}
+	}
+}
+
+func TestRotateFull(t *testing.T) {
+	p := RotatePolicy{MaxSize: 1 << 20, MaxRecords: 100}
+	if p.full(1024, 10) {
+		t.Fatal("should not be full")
+	}
+	if !p.full(1<<20, 10) {
+		t.Fatal("size limit not honored")
+	}
+	if !p.full(1024, 100) {
+		t.Fatal("record limit not honored")
+	}
+	if (&RotatePolicy{}).full(1<<40, 1<<40) {
+		t.Fatal("zero policy should never be full")
+	}
+}
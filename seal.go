@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	MANIFEST_SUFFIX = ".manifest"
+	COMPACT_SUFFIX  = ".compact"
+	COMPACT_TX_SIZE = 65536 // keys copied per transaction
+	SEALED_MODE     = 0400
+)
+
+// Manifest describes a sealed RDO file, it's written next to the file
+// as <file>.manifest, so tools can skip or verify files without opening them.
+type Manifest struct {
+	File        string    `json:"file"`         // base name of the RDO file
+	Topic       string    `json:"topic"`        // topic archived
+	Storage     string    `json:"storage"`      // storage backend of the file
+	Records     uint64    `json:"records"`      // records in file
+	DeadLetters uint64    `json:"dead_letters"` // rejected messages in file
+	FirstSeq    uint64    `json:"first_seq"`    // first record key
+	LastSeq     uint64    `json:"last_seq"`     // last record key
+	MinTS       uint64    `json:"min_ts"`       // minimum millisecond of TS
+	MaxTS       uint64    `json:"max_ts"`       // maximum millisecond of TS
+	Size        int64     `json:"size"`         // file size after sealing
+	SHA256      string    `json:"sha256"`       // hex SHA-256 of the file
+	KeyID       string    `json:"key_id"`       // id of the key encrypting the file, empty if not encrypted
+	PrevHash    string    `json:"prev_hash"`    // hex last hash of the previous file, see chain.go
+	LastHash    string    `json:"last_hash"`    // hex hash of the last record
+	Created     time.Time `json:"created"`      // creation time in file name
+	Sealed      time.Time `json:"sealed"`       // when the file was sealed
+}
+
+func manifest_path(file string) string {
+	return file + MANIFEST_SUFFIX
+}
+
+// read the manifest of a RDO file, nil if it's not sealed
+func read_manifest(file string) (*Manifest, error) {
+	bts, err := ioutil.ReadFile(manifest_path(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(bts, m); err != nil {
+		return nil, fmt.Errorf("%v: %v", manifest_path(file), err)
+	}
+	return m, nil
+}
+
+// seal a closed RDO file in background, unless it's being sealed already,
+// as two seals of a file would race on the same compacted copy
+func (arch *Archiver) seal_async(file string, created time.Time) {
+	arch.seal_mu.Lock()
+	defer arch.seal_mu.Unlock()
+	if arch.sealing_files[file] {
+		return
+	}
+	if arch.sealing_files == nil {
+		arch.sealing_files = make(map[string]bool)
+	}
+	arch.sealing_files[file] = true
+	arch.sealing.Add(1)
+	go func() {
+		defer arch.sealing.Done()
+		if _, err := arch.seal(file, created); err != nil {
+			log.Errorf("seal %v: %v", file, err)
+		}
+		arch.seal_mu.Lock()
+		delete(arch.sealing_files, file)
+		arch.seal_mu.Unlock()
+	}()
+}
+
+// whether a file is being sealed, or its seal was interrupted
+func (arch *Archiver) is_sealing(file string) bool {
+	arch.seal_mu.Lock()
+	sealing := arch.sealing_files[file]
+	arch.seal_mu.Unlock()
+	if _, err := os.Stat(file + COMPACT_SUFFIX); err == nil {
+		return true
+	}
+	return sealing
+}
+
+// seal the RDO files which are not sealed yet, except the current one
+func (arch *Archiver) seal_unsealed(current string) {
+	files, err := filepath.Glob(filepath.Join(arch.dir, "*.RDO"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, file := range files {
+		created, err := time.ParseInLocation(REDO_TIME_FORMAT, filepath.Base(file), time.Local)
+		if err != nil || file == current {
+			continue
+		}
+		if _, err := os.Stat(manifest_path(file)); os.IsNotExist(err) {
+			arch.seal_async(file, created)
+		}
+	}
+}
+
+// seal a closed RDO file by its backend, bolt files are compacted without
+// free pages, then write its manifest and make both read-only.
+func (arch *Archiver) seal(file string, created time.Time) (*Manifest, error) {
+	log.Info("seal ", file)
+	st, err := arch.cfg.file_storage(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Seal(file); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{File: filepath.Base(file), Topic: arch.topic, Created: created}
+	if err := m.stat(arch.cfg, file); err != nil {
+		return nil, err
+	}
+	size, sum, err := checksum(file)
+	if err != nil {
+		return nil, err
+	}
+	m.Size = size
+	m.SHA256 = sum
+	m.Sealed = time.Now()
+
+	// the manifest is written last, its presence marks the file sealed
+	bts, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(manifest_path(file)+COMPACT_SUFFIX, bts, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(file, SEALED_MODE); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(manifest_path(file)+COMPACT_SUFFIX, SEALED_MODE); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(manifest_path(file)+COMPACT_SUFFIX, manifest_path(file)); err != nil {
+		return nil, err
+	}
+	// the snapshot of the file is stale now
+	if err := os.Remove(snapshot_path(file)); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+	log.Infof("sealed %v, %v records, %v bytes", file, m.Records, m.Size)
+	return m, nil
+}
+
+// fill the record statistics of a manifest from a RDO file
+func (m *Manifest) stat(cfg *Config, file string) error {
+	st, err := cfg.file_storage(file)
+	if err != nil {
+		return err
+	}
+	seg, err := st.Open(file)
+	if err != nil {
+		return err
+	}
+	defer seg.Close()
+	info, err := seg.Info()
+	if err != nil {
+		return err
+	}
+
+	m.Storage = fmt.Sprint(st)
+	m.Records = info.Records
+	m.DeadLetters = info.DeadLetters
+	m.FirstSeq = info.FirstSeq
+	m.LastSeq = info.LastSeq
+	m.MinTS = info.MinTS
+	m.MaxTS = info.MaxTS
+	m.KeyID = info.KeyID
+	m.PrevHash = hex.EncodeToString(info.PrevHash)
+	m.LastHash = hex.EncodeToString(info.LastHash)
+	return nil
+}
+
+// size and hex SHA-256 of a file
+func checksum(file string) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	redo "github.com/gonet2/libs/nsq-redo"
+)
+
+func TestSeal(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+
+	d := new(test_delegate)
+	first := ts()
+	for i := 1; i <= 100; i++ {
+		r := redo.NewRedoRecord(int32(i), fmt.Sprint("api", i), first+uint64(i)<<TS_SHIFT)
+		r.AddChange("test", "", testdoc{"name", i})
+		arch.pending <- new_entry(test_message(d, i, r))
+	}
+	arch.pending <- new_entry(test_message(d, 101, []byte("garbage")))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	m, err := arch.seal(rl.file, rl.created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Records != 100 || m.DeadLetters != 1 || m.FirstSeq != 1 || m.LastSeq != 100 {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+	if m.MinTS != first>>TS_SHIFT+1 || m.MaxTS != first>>TS_SHIFT+100 {
+		t.Errorf("unexpected time range: %v %v", m.MinTS, m.MaxTS)
+	}
+	if m.LastHash != hex.EncodeToString(rl.chain) {
+		t.Errorf("unexpected last hash: %v", m.LastHash)
+	}
+
+	if saved, err := read_manifest(rl.file); err != nil || saved == nil || saved.SHA256 != m.SHA256 {
+		t.Fatal("manifest not saved", saved, err)
+	}
+	size, sum, err := checksum(rl.file)
+	if err != nil || size != m.Size || sum != m.SHA256 {
+		t.Fatal("checksum mismatch", size, sum, err)
+	}
+	if fi, err := os.Stat(rl.file); err != nil || fi.Mode().Perm() != SEALED_MODE {
+		t.Fatal("file should be read-only", fi.Mode(), err)
+	}
+	if _, err := os.Stat(rl.file + COMPACT_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("temporary file left", err)
+	}
+
+	// compacted file keeps everything
+	db, err := bolt.Open(rl.file, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range append([]string{arch.cfg.Bucket, CHAIN_BUCKET}, index_buckets...) {
+			if n := tx.Bucket([]byte(name)).Stats().KeyN; n != 100 {
+				t.Error(name, "keys:", n)
+			}
+		}
+		return nil
+	})
+
+	// a sealed file is never resumed
+	if rl := arch.resume_redolog(); rl != nil {
+		rl.Close()
+		t.Fatal("sealed file resumed")
+	}
+}
+
+func TestCompactChunks(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+
+	// more keys than a compaction transaction
+	n := COMPACT_TX_SIZE*2 + 10
+	err := rl.Segment.(*bolt_segment).Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(arch.cfg.Bucket))
+		for i := 0; i < n; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), []byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	rl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := rl.file + ".copy"
+	if err := compact(rl.file, dst); err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if keys := tx.Bucket([]byte(arch.cfg.Bucket)).Stats().KeyN; keys != n {
+			t.Error("keys copied:", keys)
+		}
+		return nil
+	})
+}
+
+// a file being sealed isn't sealed again
+func TestSealOnce(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+	d := new(test_delegate)
+	r := redo.NewRedoRecord(1, "api", ts())
+	r.AddChange("test", "", testdoc{"name", 1})
+	arch.pending <- new_entry(test_message(d, 1, r))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	arch.sealing_files = map[string]bool{rl.file: true}
+	arch.seal_unsealed("")
+	arch.sealing.Wait()
+	if m, _ := read_manifest(rl.file); m != nil {
+		t.Fatal("sealed twice")
+	}
+	delete(arch.sealing_files, rl.file)
+	arch.seal_unsealed("")
+	arch.sealing.Wait()
+	if m, err := read_manifest(rl.file); m == nil || m.Records != 1 {
+		t.Fatal("not sealed", err)
+	}
+	if len(arch.sealing_files) != 0 {
+		t.Error("sealed file still tracked")
+	}
+}
+
+// a compacted file is appended from its sequences
+func TestCompactSequence(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	st := arch.cfg.storage()
+	file := filepath.Join(arch.dir, time.Now().Format(REDO_TIME_FORMAT))
+	seg, err := st.Create(file, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Append(test_batch(0, 0, 10, nil)); err != nil {
+		t.Fatal(err)
+	}
+	seg.Close()
+
+	if err := compact(file, file+COMPACT_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file+COMPACT_SUFFIX, file); err != nil {
+		t.Fatal(err)
+	}
+	if seg, err = st.Create(file, nil, "", false); err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	seq, dead, chain := seg.Tail()
+	if err := seg.Append(test_batch(seq, dead, 2, chain)); err != nil {
+		t.Fatal("compacted file not appended:", err)
+	}
+	if seq, dead, _ = seg.Tail(); seq != 12 || dead != 2 {
+		t.Error("unexpected tail", seq, dead)
+	}
+}
+
+// a file being sealed isn't resumed after a failed rotation
+func TestRotateFailed(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+	old := rl.file
+
+	// the new file can't be created, and the old one is still being sealed
+	now := time.Now()
+	var blocked []string
+	for i := 1; i <= 3; i++ {
+		dir := filepath.Join(arch.dir, now.Add(time.Duration(i)*time.Second).Format(REDO_TIME_FORMAT))
+		os.Mkdir(dir, 0755)
+		blocked = append(blocked, dir)
+	}
+	time.Sleep(time.Second)
+	arch.sealing_files = map[string]bool{old: true}
+	if rl, err := arch.rotate_redolog(rl); err == nil {
+		rl.Close()
+		t.Fatal("rotated")
+	}
+	for _, dir := range blocked {
+		os.Remove(dir)
+	}
+	if rl := arch.resume_redolog(); rl != nil {
+		rl.Close()
+		t.Fatal("file being sealed resumed")
+	}
+
+	// or its seal is interrupted
+	delete(arch.sealing_files, old)
+	ioutil.WriteFile(old+COMPACT_SUFFIX, nil, 0600)
+	if rl := arch.resume_redolog(); rl != nil {
+		rl.Close()
+		t.Fatal("file of an interrupted seal resumed")
+	}
+	os.Remove(old + COMPACT_SUFFIX)
+	rl = arch.resume_redolog()
+	if rl == nil || rl.file != old {
+		t.Fatal("file not resumed")
+	}
+	rl.Close()
+}
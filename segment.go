@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// a segment file is a header followed by frames appended in batches:
+//
+//	header: magic(8) | meta length(4) | meta json | crc32c(4)
+//	frame:  kind(1) | seq(8) | ts(8) | value length(4) | hash length(1) | value | hash | crc32c(4)
+//
+// ts is the millisecond of the record TS, the CRCs are big endian CRC32C of
+// what precedes them. a torn frame at the end is truncated when the file is
+// opened for append, a file with a corrupt frame before the end isn't
+// opened. sealing appends an index frame of every SEGMENT_INDEX_INTERVAL-th
+// record offset and the counters, followed by a trailer pointing to it, so
+// sealed files are opened without a scan.
+const (
+	SEGMENT_MAGIC          = "RDOSEG\x00\x01"
+	SEGMENT_TRAILER_MAGIC  = "SIDX"
+	SEGMENT_INDEX_INTERVAL = 128
+	SEGMENT_MAX_META       = 1 << 16
+
+	FRAME_RECORD      = 1
+	FRAME_DEAD_LETTER = 2
+	FRAME_INDEX       = 3
+
+	FRAME_HEADER_SIZE   = 22
+	SEGMENT_TRAILER     = 12 // offset of the index frame(8) | magic(4)
+	INDEX_SUMMARY_SIZE  = 32 // records, dead letters, min ts, max ts
+	INDEX_ENTRY_SIZE    = 16 // seq, offset
+	SEGMENT_SCAN_BUFFER = 1 << 16
+)
+
+var (
+	ERR_SEGMENT_SEALED = errors.New("segment is sealed")
+	ERR_FRAME_TORN     = errors.New("torn frame")
+	ERR_STOP_SCAN      = errors.New("stop scan")
+)
+
+type segment_storage struct{}
+
+// written in the header
+type segment_meta struct {
+	KeyID    string `json:"key_id,omitempty"`
+	PrevHash []byte `json:"prev_hash,omitempty"`
+}
+
+// a frame read back
+type frame struct {
+	kind  byte
+	seq   uint64
+	ts    uint64
+	value []byte
+	hash  []byte
+	size  int64 // bytes in file
+}
+
+// offset of a record frame
+type index_entry struct {
+	seq uint64
+	off int64
+}
+
+type segment struct {
+	mu           sync.RWMutex
+	f            *os.File
+	nosync       bool
+	sealed       bool
+	meta         segment_meta
+	data         int64 // offset of the first frame
+	end          int64 // end of the last frame
+	count        uint64
+	first_seq    uint64
+	records      uint64 // last record sequence
+	dead_letters uint64 // last dead letter sequence
+	min_ts       uint64
+	max_ts       uint64
+	chain        []byte // hash of the last record
+	index        []index_entry
+}
+
+func (st segment_storage) Create(file string, prev []byte, key_id string, nosync bool) (Segment, error) {
+	s, err := open_segment(file, os.O_RDWR|os.O_CREATE, syscall.LOCK_EX)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", file, err)
+	}
+	s.nosync = nosync
+	if s.data == 0 {
+		s.meta = segment_meta{KeyID: key_id, PrevHash: prev}
+		err = s.write_header()
+	} else if s.sealed {
+		err = ERR_SEGMENT_SEALED
+	}
+	if err != nil {
+		s.f.Close()
+		return nil, fmt.Errorf("open %v: %v", file, err)
+	}
+	return s, nil
+}
+
+func (st segment_storage) Open(file string) (Segment, error) {
+	return open_segment(file, os.O_RDONLY, syscall.LOCK_SH)
+}
+
+// append the sparse index and the trailer
+func (st segment_storage) Seal(file string) error {
+	s, err := open_segment(file, os.O_RDWR, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer s.f.Close()
+	if s.sealed {
+		return nil
+	} else if s.data == 0 {
+		return errors.New("empty segment")
+	}
+
+	summary := make([]byte, INDEX_SUMMARY_SIZE, INDEX_SUMMARY_SIZE+len(s.index)*INDEX_ENTRY_SIZE)
+	binary.BigEndian.PutUint64(summary[0:], s.count)
+	binary.BigEndian.PutUint64(summary[8:], s.dead_letters)
+	binary.BigEndian.PutUint64(summary[16:], s.min_ts)
+	binary.BigEndian.PutUint64(summary[24:], s.max_ts)
+	entry := make([]byte, INDEX_ENTRY_SIZE)
+	for _, e := range s.index {
+		binary.BigEndian.PutUint64(entry, e.seq)
+		binary.BigEndian.PutUint64(entry[8:], uint64(e.off))
+		summary = append(summary, entry...)
+	}
+	buf := append_frame(nil, FRAME_INDEX, s.records, 0, summary, s.chain)
+	trailer := make([]byte, SEGMENT_TRAILER)
+	binary.BigEndian.PutUint64(trailer, uint64(s.end))
+	copy(trailer[8:], SEGMENT_TRAILER_MAGIC)
+	buf = append(buf, trailer...)
+	if _, err := s.f.WriteAt(buf, s.end); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// open and lock a segment file, then load it from its index if it's sealed,
+// or by scanning its frames
+func open_segment(file string, flag int, lock int) (*segment, error) {
+	f, err := os.OpenFile(file, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), lock|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, ERR_LOCKED
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &segment{f: f}
+	if err := s.load(flag&(os.O_RDWR|os.O_WRONLY) != 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return s, nil
+}
+
+func (s *segment) write_header() error {
+	meta, err := json.Marshal(&s.meta)
+	if err != nil {
+		return err
+	}
+	buf := append([]byte(SEGMENT_MAGIC), make([]byte, 4)...)
+	binary.BigEndian.PutUint32(buf[len(SEGMENT_MAGIC):], uint32(len(meta)))
+	buf = append(buf, meta...)
+	buf = append_crc(buf)
+	if _, err := s.f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	s.data = int64(len(buf))
+	s.end = s.data
+	s.chain = s.meta.PrevHash
+	return s.f.Sync()
+}
+
+func (s *segment) load(writable bool) error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		if !writable {
+			return errors.New("empty segment")
+		}
+		return nil
+	}
+
+	// header
+	head := make([]byte, len(SEGMENT_MAGIC)+4)
+	if _, err := s.f.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if string(head[:len(SEGMENT_MAGIC)]) != SEGMENT_MAGIC {
+		return errors.New("not a segment file")
+	}
+	n := int64(binary.BigEndian.Uint32(head[len(SEGMENT_MAGIC):]))
+	if n > SEGMENT_MAX_META || int64(len(head))+n+CRC_SIZE > size {
+		return errors.New("invalid segment header")
+	}
+	buf := make([]byte, int64(len(head))+n+CRC_SIZE)
+	if _, err := s.f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if !check_crc(buf) {
+		return ERR_CHECKSUM
+	}
+	if err := json.Unmarshal(buf[len(head):len(buf)-CRC_SIZE], &s.meta); err != nil {
+		return err
+	}
+	s.data = int64(len(buf))
+	s.end = s.data
+	s.chain = s.meta.PrevHash
+
+	if s.load_index(size) {
+		return nil
+	}
+
+	// scan the frames
+	r := bufio.NewReaderSize(io.NewSectionReader(s.f, s.data, size-s.data), SEGMENT_SCAN_BUFFER)
+	for {
+		fr, err := read_frame(r, size-s.end)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !writable {
+				log.Warnf("%v: %v at %v, ignore %v bytes", s.f.Name(), err, s.end, size-s.end)
+				break
+			}
+			// a crash leaves a torn frame at the end, a corrupt frame
+			// followed by others is damage left in place for verify. a frame
+			// longer than the rest of the file may be a flipped length, it's
+			// torn only if its header is.
+			torn := err == ERR_FRAME_TORN && s.end+FRAME_HEADER_SIZE >= size
+			if !torn && (err != ERR_CHECKSUM || s.end+fr.size != size) {
+				return fmt.Errorf("%v at %v, not appended", err, s.end)
+			}
+			log.Warnf("%v: %v at %v, truncate %v bytes", s.f.Name(), err, s.end, size-s.end)
+			if err := s.f.Truncate(s.end); err != nil {
+				return err
+			}
+			break
+		}
+		if fr.kind == FRAME_INDEX {
+			// sealed, but the trailer is lost
+			break
+		}
+		s.add(fr, s.end)
+		s.end += fr.size
+	}
+	return nil
+}
+
+// load a sealed segment from its index frame, false if there's none
+func (s *segment) load_index(size int64) bool {
+	if size < s.data+SEGMENT_TRAILER {
+		return false
+	}
+	trailer := make([]byte, SEGMENT_TRAILER)
+	if _, err := s.f.ReadAt(trailer, size-SEGMENT_TRAILER); err != nil || string(trailer[8:]) != SEGMENT_TRAILER_MAGIC {
+		return false
+	}
+	off := int64(binary.BigEndian.Uint64(trailer))
+	if off < s.data || off > size-SEGMENT_TRAILER {
+		return false
+	}
+	fr, err := read_frame(io.NewSectionReader(s.f, off, size-SEGMENT_TRAILER-off), size-SEGMENT_TRAILER-off)
+	if err != nil || fr.kind != FRAME_INDEX || len(fr.value) < INDEX_SUMMARY_SIZE || (len(fr.value)-INDEX_SUMMARY_SIZE)%INDEX_ENTRY_SIZE != 0 {
+		return false
+	}
+
+	v := fr.value
+	s.count = binary.BigEndian.Uint64(v[0:])
+	s.dead_letters = binary.BigEndian.Uint64(v[8:])
+	s.min_ts = binary.BigEndian.Uint64(v[16:])
+	s.max_ts = binary.BigEndian.Uint64(v[24:])
+	for v = v[INDEX_SUMMARY_SIZE:]; len(v) > 0; v = v[INDEX_ENTRY_SIZE:] {
+		s.index = append(s.index, index_entry{binary.BigEndian.Uint64(v), int64(binary.BigEndian.Uint64(v[8:]))})
+	}
+	if len(s.index) > 0 {
+		s.first_seq = s.index[0].seq
+	}
+	s.records = fr.seq
+	s.chain = fr.hash
+	s.end = off
+	s.sealed = true
+	return true
+}
+
+// account a frame at off
+func (s *segment) add(fr *frame, off int64) {
+	switch fr.kind {
+	case FRAME_RECORD:
+		if s.count%SEGMENT_INDEX_INTERVAL == 0 {
+			s.index = append(s.index, index_entry{fr.seq, off})
+		}
+		if s.count == 0 {
+			s.first_seq = fr.seq
+		}
+		s.count++
+		s.records = fr.seq
+		s.chain = fr.hash
+		if fr.ts > 0 && (s.min_ts == 0 || fr.ts < s.min_ts) {
+			s.min_ts = fr.ts
+		}
+		if fr.ts > s.max_ts {
+			s.max_ts = fr.ts
+		}
+	case FRAME_DEAD_LETTER:
+		s.dead_letters = fr.seq
+	}
+}
+
+func append_crc(buf []byte) []byte {
+	crc := make([]byte, CRC_SIZE)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(buf, crc_table))
+	return append(buf, crc...)
+}
+
+func check_crc(buf []byte) bool {
+	n := len(buf) - CRC_SIZE
+	return n >= 0 && crc32.Checksum(buf[:n], crc_table) == binary.BigEndian.Uint32(buf[n:])
+}
+
+func append_frame(buf []byte, kind byte, seq, ts uint64, value, hash []byte) []byte {
+	start := len(buf)
+	head := make([]byte, FRAME_HEADER_SIZE)
+	head[0] = kind
+	binary.BigEndian.PutUint64(head[1:], seq)
+	binary.BigEndian.PutUint64(head[9:], ts)
+	binary.BigEndian.PutUint32(head[17:], uint32(len(value)))
+	head[21] = byte(len(hash))
+	buf = append(buf, head...)
+	buf = append(buf, value...)
+	buf = append(buf, hash...)
+	crc := make([]byte, CRC_SIZE)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(buf[start:], crc_table))
+	return append(buf, crc...)
+}
+
+// read a frame of at most limit bytes, io.EOF at the end. a frame failing
+// its CRC is returned with its size only, along with ERR_CHECKSUM.
+func read_frame(r io.Reader, limit int64) (*frame, error) {
+	head := make([]byte, FRAME_HEADER_SIZE)
+	if n, err := io.ReadFull(r, head); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		if n > 0 {
+			return nil, ERR_FRAME_TORN
+		}
+		return nil, err
+	}
+	vlen, hlen := int64(binary.BigEndian.Uint32(head[17:])), int64(head[21])
+	size := FRAME_HEADER_SIZE + vlen + hlen + CRC_SIZE
+	if size > limit {
+		return nil, ERR_FRAME_TORN
+	}
+	buf := make([]byte, size)
+	copy(buf, head)
+	if _, err := io.ReadFull(r, buf[FRAME_HEADER_SIZE:]); err != nil {
+		return nil, ERR_FRAME_TORN
+	}
+	if !check_crc(buf) {
+		return &frame{size: size}, ERR_CHECKSUM
+	}
+	fr := &frame{
+		kind: head[0],
+		seq:  binary.BigEndian.Uint64(head[1:]),
+		ts:   binary.BigEndian.Uint64(head[9:]),
+		size: size,
+	}
+	fr.value = buf[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+vlen]
+	if hlen > 0 {
+		fr.hash = buf[FRAME_HEADER_SIZE+vlen : FRAME_HEADER_SIZE+vlen+hlen]
+	}
+	return fr, nil
+}
+
+// frames are written at the end in a single write, and cut off on failure
+func (s *segment) Append(batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ERR_SEGMENT_CLOSED
+	}
+	if s.sealed {
+		return ERR_SEGMENT_SEALED
+	}
+
+	var buf []byte
+	var frames []*frame
+	records, dead_letters := s.records, s.dead_letters
+	for _, r := range batch.Records {
+		if records++; r.Seq != records {
+			return fmt.Errorf("sequence %v, expect %v", r.Seq, records)
+		}
+		var ts uint64
+		if r.Rec != nil {
+			ts = r.Rec.TS >> TS_SHIFT
+		}
+		n := len(buf)
+		buf = append_frame(buf, FRAME_RECORD, r.Seq, ts, r.Value, r.Hash)
+		frames = append(frames, &frame{kind: FRAME_RECORD, seq: r.Seq, ts: ts, hash: r.Hash, size: int64(len(buf) - n)})
+	}
+	for _, r := range batch.DeadLetters {
+		if dead_letters++; r.Seq != dead_letters {
+			return fmt.Errorf("dead letter sequence %v, expect %v", r.Seq, dead_letters)
+		}
+		n := len(buf)
+		buf = append_frame(buf, FRAME_DEAD_LETTER, r.Seq, 0, r.Value, nil)
+		frames = append(frames, &frame{kind: FRAME_DEAD_LETTER, seq: r.Seq, size: int64(len(buf) - n)})
+	}
+
+	_, err := s.f.WriteAt(buf, s.end)
+	if err == nil && !s.nosync {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		s.f.Truncate(s.end)
+		return err
+	}
+	for _, fr := range frames {
+		s.add(fr, s.end)
+		s.end += fr.size
+	}
+	return nil
+}
+
+// the frames of f from off to end, read without the lock, appends only go beyond end
+func (s *segment) frames(f *os.File, off, end int64, fn func(fr *frame, off int64) error) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, off, end-off), SEGMENT_SCAN_BUFFER)
+	for off < end {
+		fr, err := read_frame(r, end-off)
+		if err != nil {
+			return s.error(err)
+		}
+		if err := fn(fr, off); err != nil {
+			return err
+		}
+		off += fr.size
+	}
+	return nil
+}
+
+// the range to read, ERR_SEGMENT_CLOSED once closed
+func (s *segment) bounds() (f *os.File, data, end int64, index []index_entry, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return nil, 0, 0, nil, ERR_SEGMENT_CLOSED
+	}
+	return s.f, s.data, s.end, s.index, nil
+}
+
+// seek the sparse index, then scan at most an interval of frames
+func (s *segment) Get(seq uint64) ([]byte, error) {
+	f, data, end, index, err := s.bounds()
+	if err != nil {
+		return nil, err
+	}
+	off := data
+	if i := sort.Search(len(index), func(i int) bool { return index[i].seq > seq }); i > 0 {
+		off = index[i-1].off
+	}
+	var v []byte
+	err = s.frames(f, off, end, func(fr *frame, _ int64) error {
+		if fr.kind != FRAME_RECORD {
+			return nil
+		}
+		if fr.seq == seq {
+			v = fr.value
+		}
+		if fr.seq >= seq {
+			return ERR_STOP_SCAN
+		}
+		return nil
+	})
+	if err == ERR_STOP_SCAN {
+		err = nil
+	}
+	return v, err
+}
+
+// records are sought through the sparse index, dead letters are scanned from the start
+func (s *segment) Iterate(dead bool, from uint64, fn func(seq uint64, v, hash []byte) error) error {
+	f, data, end, index, err := s.bounds()
+	if err != nil {
+		return err
+	}
+	kind := byte(FRAME_RECORD)
+	if dead {
+		kind = FRAME_DEAD_LETTER
+	}
+	off := data
+	if i := sort.Search(len(index), func(i int) bool { return index[i].seq > from }); !dead && i > 0 {
+		off = index[i-1].off
+	}
+	return s.frames(f, off, end, func(fr *frame, _ int64) error {
+		if fr.kind != kind || fr.seq < from {
+			return nil
+		}
+		return fn(fr.seq, fr.value, fr.hash)
+	})
+}
+
+func (s *segment) Tail() (uint64, uint64, []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.records, s.dead_letters, s.chain
+}
+
+func (s *segment) KeyID() string {
+	return s.meta.KeyID
+}
+
+func (s *segment) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.sealed {
+		if fi, err := s.f.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return s.end
+}
+
+func (s *segment) Info() (*SegmentInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return nil, ERR_SEGMENT_CLOSED
+	}
+	info := &SegmentInfo{
+		Records:     s.count,
+		DeadLetters: s.dead_letters,
+		FirstSeq:    s.first_seq,
+		LastSeq:     s.records,
+		MinTS:       s.min_ts,
+		MaxTS:       s.max_ts,
+		KeyID:       s.meta.KeyID,
+		Chained:     true,
+		PrevHash:    s.meta.PrevHash,
+		LastHash:    append([]byte(nil), s.chain...),
+	}
+	return info, nil
+}
+
+// frames are never rewritten, so a prefix of the file is consistent
+func (s *segment) Snapshot(w io.Writer) (records uint64, n int64, err error) {
+	s.mu.RLock()
+	f, end, records := s.f, s.end, s.records
+	s.mu.RUnlock()
+	if f == nil {
+		return 0, 0, ERR_SEGMENT_CLOSED
+	}
+	n, err = io.Copy(w, io.NewSectionReader(f, 0, end))
+	return records, n, s.error(err)
+}
+
+func (s *segment) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return ERR_SEGMENT_CLOSED
+	}
+	return s.f.Sync()
+}
+
+func (s *segment) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// reads racing with Close fail on the closed file
+func (s *segment) error(err error) error {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == os.ErrClosed {
+		return ERR_SEGMENT_CLOSED
+	}
+	return err
+}
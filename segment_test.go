@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a batch of n records following seq, and a dead letter following dead
+func test_batch(seq, dead uint64, n int, chain []byte) *Batch {
+	b := new(Batch)
+	for i := 0; i < n; i++ {
+		seq++
+		v := []byte(fmt.Sprint("value", seq))
+		chain = chain_hash(chain, seq_key(seq), v)
+		rec := &RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test"}}}
+		b.Records = append(b.Records, Record{Seq: seq, Value: v, Hash: chain, Rec: rec})
+	}
+	b.DeadLetters = []Record{{Seq: dead + 1, Value: []byte("dead")}}
+	return b
+}
+
+func TestSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, time.Now().Format(REDO_TIME_FORMAT))
+	st := segment_storage{}
+
+	seg, err := st.Create(file, []byte("prev"), "k1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 batches over more than a sparse index interval
+	var seq, dead uint64
+	_, _, chain := seg.Tail()
+	for i := 0; i < 3; i++ {
+		b := test_batch(seq, dead, SEGMENT_INDEX_INTERVAL, chain)
+		if err := seg.Append(b); err != nil {
+			t.Fatal(err)
+		}
+		seq, dead, chain = seg.Tail()
+	}
+	if err := seg.Append(test_batch(seq+1, dead, 1, chain)); err == nil {
+		t.Error("sequence gap appended")
+	}
+	if _, err := st.Open(file); err != ERR_LOCKED {
+		t.Error("opened while written", err)
+	}
+	seg.Close()
+
+	// a torn frame is cut off on append
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{FRAME_RECORD, 0, 0, 0})
+	f.Close()
+	if seg, err = st.Create(file, nil, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if records, dead_letters, hash := seg.Tail(); records != seq || dead_letters != 3 || !bytes.Equal(hash, chain) || seg.KeyID() != "k1" {
+		t.Fatal("not resumed", records, dead_letters, seg.KeyID())
+	}
+	size := seg.Size()
+	seg.Close()
+	if fi, _ := os.Stat(file); fi.Size() != size {
+		t.Fatal("torn frame not truncated", fi.Size(), size)
+	}
+
+	if err := st.Seal(file); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := st.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	info, err := ro.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Records != seq || info.DeadLetters != 3 || info.FirstSeq != 1 || info.LastSeq != seq ||
+		!bytes.Equal(info.LastHash, chain) || string(info.PrevHash) != "prev" || info.MinTS == 0 || info.MaxTS < info.MinTS {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	for _, seq := range []uint64{1, SEGMENT_INDEX_INTERVAL, SEGMENT_INDEX_INTERVAL + 1, seq} {
+		if v, err := ro.Get(seq); err != nil || string(v) != fmt.Sprint("value", seq) {
+			t.Error("get", seq, string(v), err)
+		}
+	}
+	if v, err := ro.Get(seq + 1); v != nil || err != nil {
+		t.Error("get beyond the end", v, err)
+	}
+	var n, dn int
+	ro.Iterate(false, 0, func(seq uint64, v, hash []byte) error { n++; return nil })
+	ro.Iterate(true, 0, func(seq uint64, v, hash []byte) error { dn++; return nil })
+	if uint64(n) != seq || dn != 3 {
+		t.Error("iterated", n, dn)
+	}
+	// from a sequence past an index entry
+	var first uint64
+	n = 0
+	ro.Iterate(false, SEGMENT_INDEX_INTERVAL+2, func(seq uint64, v, hash []byte) error {
+		if n++; first == 0 {
+			first = seq
+		}
+		return nil
+	})
+	if first != SEGMENT_INDEX_INTERVAL+2 || uint64(n) != seq-SEGMENT_INDEX_INTERVAL-1 {
+		t.Error("iterated from", first, n)
+	}
+	if _, err := st.Create(file, nil, "", false); err == nil {
+		t.Error("sealed segment opened to append")
+	}
+}
+
+// a corrupt frame is only cut off at the end
+func TestSegmentCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, time.Now().Format(REDO_TIME_FORMAT))
+	st := segment_storage{}
+	seg, err := st.Create(file, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Append(test_batch(0, 0, 10, nil)); err != nil {
+		t.Fatal(err)
+	}
+	seg.Close()
+	clean, _ := ioutil.ReadFile(file)
+
+	bts := append([]byte(nil), clean...)
+	i := bytes.Index(bts, []byte{FRAME_RECORD, 0, 0, 0, 0, 0, 0, 0, 4})
+	bts[i+FRAME_HEADER_SIZE] ^= 1
+	ioutil.WriteFile(file, bts, 0600)
+	if _, err := st.Create(file, nil, "", false); err == nil {
+		t.Error("corrupt segment opened to append")
+	}
+	if err := st.Seal(file); err == nil {
+		t.Error("corrupt segment sealed")
+	}
+	if fi, _ := os.Stat(file); fi.Size() != int64(len(clean)) {
+		t.Fatal("corrupt segment truncated", fi.Size(), len(clean))
+	}
+
+	// a flipped bit of the value length of record 4
+	bts = append([]byte(nil), clean...)
+	bts[i+17] ^= 0x80
+	ioutil.WriteFile(file, bts, 0600)
+	if _, err := st.Create(file, nil, "", false); err == nil {
+		t.Error("segment with a corrupt frame length opened to append")
+	}
+	if fi, _ := os.Stat(file); fi.Size() != int64(len(clean)) {
+		t.Fatal("corrupt frame length truncated", fi.Size(), len(clean))
+	}
+
+	// the dead letter is the last frame
+	bts = append([]byte(nil), clean...)
+	bts[len(bts)-CRC_SIZE-1] ^= 1
+	ioutil.WriteFile(file, bts, 0600)
+	if seg, err = st.Create(file, nil, "", false); err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if records, dead_letters, _ := seg.Tail(); records != 10 || dead_letters != 0 {
+		t.Error("last frame not truncated", records, dead_letters)
+	}
+}
+
+func TestSegmentArchive(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	arch.cfg.Storage = STORAGE_SEGMENT
+	arch.cfg.Compression = COMPRESSION_SNAPPY
+	rl := test_open(t, arch)
+
+	d := new(test_delegate)
+	for i := 1; i <= 10; i++ {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		arch.enqueue(new_entry(test_message(d, i, r)))
+	}
+	arch.pending <- new_entry(test_message(d, 11, []byte("garbage")))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	if d.finished != 11 || rl.records != 10 || rl.dead_letters != 1 {
+		t.Fatal("not committed", d.finished, rl.records, rl.dead_letters)
+	}
+
+	// snapshots are a prefix of the file
+	s, err := arch.snapshot("")
+	if err != nil || s.Records != 10 {
+		t.Fatal("snapshot", s, err)
+	}
+
+	// rotated files are chained and sealed by their own backend
+	arch.cfg.Storage = STORAGE_BOLT
+	time.Sleep(time.Second)
+	next, err := arch.rotate_redolog(rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Close()
+	arch.sealing.Wait()
+	m, err := read_manifest(rl.file)
+	if err != nil || m == nil || m.Storage != STORAGE_SEGMENT || m.Records != 10 || m.DeadLetters != 1 {
+		t.Fatalf("unexpected manifest %+v: %v", m, err)
+	}
+
+	var out bytes.Buffer
+	if ok, err := verify_data(arch.cfg, &out); !ok || err != nil {
+		t.Fatalf("verify failed: %s %v", out.Bytes(), err)
+	}
+
+	// a flipped bit fails the frame CRC
+	bts, _ := ioutil.ReadFile(rl.file)
+	i := bytes.Index(bts, []byte{FRAME_RECORD, 0, 0, 0, 0, 0, 0, 0, 5})
+	bts[i+FRAME_HEADER_SIZE] ^= 1
+	os.Chmod(rl.file, 0600)
+	ioutil.WriteFile(rl.file, bts, 0600)
+	r, _ := verify_file(arch.cfg, rl.file, nil)
+	if r.Records != 4 || len(r.Problems) == 0 || r.Problems[0].Seq != 5 || r.Problems[0].Check != CHECK_CRC {
+		t.Errorf("corruption not reported %+v", r)
+	}
+}
+
+// write throughput of the backends, batches of BATCH_SIZE records
+func bench_append(b *testing.B, st Storage) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seg, err := st.Create(filepath.Join(dir, "bench.RDO"), nil, "", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer seg.Close()
+
+	v := make([]byte, 256)
+	rec := &RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test"}}}
+	b.SetBytes(int64(len(v)))
+	b.ResetTimer()
+	for seq := 0; seq < b.N; {
+		batch := new(Batch)
+		for i := 0; i < BATCH_SIZE && seq < b.N; i++ {
+			seq++
+			batch.Records = append(batch.Records, Record{Seq: uint64(seq), Value: v, Hash: v[:32], Rec: rec})
+		}
+		if err := seg.Append(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendBolt(b *testing.B)    { bench_append(b, bolt_storage{BOLTDB_BUCKET}) }
+func BenchmarkAppendSegment(b *testing.B) { bench_append(b, segment_storage{}) }
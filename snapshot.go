@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// a snapshot of the file being written is kept next to it as
+// <file>.snapshot, replay loads it in place of the locked file.
+// it's removed once the file is sealed.
+const (
+	SNAPSHOT_SUFFIX  = ".snapshot"
+	SNAPSHOT_RETRIES = 3 // the file may rotate while taking a snapshot
+)
+
+// Snapshot is a consistent copy of the file being written
+type Snapshot struct {
+	Topic    string `json:"topic"`
+	File     string `json:"file"`     // the file copied
+	Snapshot string `json:"snapshot"` // the copy
+	Records  uint64 `json:"records"`
+	Size     int64  `json:"size"`
+}
+
+func snapshot_path(file string) string {
+	return file + SNAPSHOT_SUFFIX
+}
+
+// the redolog being written, nil if there's none
+func (arch *Archiver) live_redolog() *redolog {
+	arch.mu.Lock()
+	defer arch.mu.Unlock()
+	return arch.live
+}
+
+// copy the file being written to dst, commits go on meanwhile. the copy is
+// written to a local file first, a slow reader holding a bolt transaction
+// would block bolt from growing the file.
+func (arch *Archiver) snapshot(dst string) (*Snapshot, error) {
+	for i := 0; i < SNAPSHOT_RETRIES; i++ {
+		rl := arch.live_redolog()
+		if rl == nil {
+			return nil, errors.New("no file being written")
+		}
+		if dst == "" {
+			dst = snapshot_path(rl.file)
+		}
+		s := &Snapshot{Topic: arch.topic, File: rl.file, Snapshot: dst}
+		err := arch.write_snapshot(rl, s)
+		if err == ERR_SEGMENT_CLOSED {
+			// rotated meanwhile
+			if dst == snapshot_path(rl.file) {
+				dst = ""
+			}
+			continue
+		}
+		return s, err
+	}
+	return nil, errors.New("file rotated while taking snapshot")
+}
+
+func (arch *Archiver) write_snapshot(rl *redolog, s *Snapshot) error {
+	tmp := s.Snapshot + COMPACT_SUFFIX
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s.Records, s.Size, err = rl.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.Snapshot)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// GET /snapshot?topic= downloads a snapshot of the file being written,
+// POST /snapshot[?topic=] writes <file>.snapshot next to it
+func (m *Manager) admin_snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		m.admin("POST", func(arch *Archiver) (interface{}, error) {
+			return arch.snapshot("")
+		})(w, r)
+		return
+	} else if r.Method != "GET" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mu.Lock()
+	arch, ok := m.archivers[r.FormValue("topic")]
+	m.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("topic %q not archived", r.FormValue("topic")), http.StatusNotFound)
+		return
+	}
+
+	f, err := ioutil.TempFile(arch.dir, "download")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	s, err := arch.snapshot(f.Name())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(snapshot_path(s.File))))
+	http.ServeFile(w, r, s.Snapshot)
+}
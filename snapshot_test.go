@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSnapshot(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+	defer rl.Close()
+
+	d := new(test_delegate)
+	for i := 1; i <= 10; i++ {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		arch.pending <- new_entry(test_message(d, i, r))
+	}
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the live file is locked, the snapshot opens
+	s, err := arch.snapshot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Snapshot != snapshot_path(rl.file) || s.Records != 10 {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+	db, err := bolt.Open(s.Snapshot, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte(arch.cfg.Bucket)).Stats().KeyN; n != 10 {
+			t.Error("records in snapshot:", n)
+		}
+		return nil
+	})
+	db.Close()
+
+	// download
+	m := &Manager{cfg: arch.cfg, archivers: map[string]*Archiver{arch.topic: arch}}
+	srv := httptest.NewServer(m.admin_handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/snapshot?topic=" + arch.topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || int64(len(bts)) != s.Size {
+		t.Fatal("download failed", resp.Status, len(bts), err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(arch.dir, "download*")); len(tmp) != 0 {
+		t.Error("temporary file left", tmp)
+	}
+
+	// stale once sealed
+	rl.Close()
+	if _, err := arch.seal(rl.file, rl.created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.Snapshot); !os.IsNotExist(err) {
+		t.Error("snapshot of a sealed file left", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nsq "github.com/bitly/go-nsq"
+)
+
+// sources of messages, chosen by -source
+const (
+	SOURCE_NSQ  = "nsq"  // consume a channel from nsqd, see nsq_source.go
+	SOURCE_HTTP = "http" // producers post to /pub, see http_source.go
+	SOURCE_FILE = "file" // a stream of BSON documents, see file_source.go
+)
+
+// Source delivers messages to an archiver, the messages of all sources are
+// nsq messages. a delivered message is acknowledged through its delegate,
+// FIN once committed or REQ if it can't be, it's delivered again then.
+type Source interface {
+	// start delivering messages to handler
+	Start(handler func(*nsq.Message)) error
+	// limit the messages delivered but not acknowledged yet, 0 pauses
+	ChangeMaxInFlight(n int)
+	// stop delivering, Done is closed once the delivered messages are acknowledged
+	Stop()
+	// closed once stopped, or once a finite source is exhausted
+	Done() <-chan int
+}
+
+func (cfg *Config) new_source(topic string) (Source, error) {
+	switch cfg.Source {
+	case SOURCE_HTTP:
+		return new_http_source(topic, cfg.max_in_flight()), nil
+	case SOURCE_FILE:
+		return new_file_source(cfg.Input, cfg.max_in_flight()), nil
+	}
+	return new_nsq_source(cfg, topic)
+}
+
+// messages in flight, nsq counts them itself, the other sources use a window
+func (cfg *Config) max_in_flight() int {
+	if c, err := cfg.nsq_config(); err == nil {
+		return c.MaxInFlight
+	}
+	return cfg.QueueSize
+}
+
+// ids of the messages not coming from nsq, unique across restarts as they
+// start from the current time
+var _message_id = uint64(time.Now().UnixNano())
+
+func new_message(body []byte, addr string) *nsq.Message {
+	var id nsq.MessageID
+	copy(id[:], fmt.Sprintf("%016x", atomic.AddUint64(&_message_id, 1)))
+	msg := nsq.NewMessage(id, body)
+	msg.Attempts = 1
+	msg.NSQDAddress = addr
+	return msg
+}
+
+// window limits the messages in flight of a source, they're acquired on
+// delivery and released on acknowledgement
+type window struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	n       int
+	stopped bool
+}
+
+func new_window(max int) *window {
+	w := &window{max: max}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// acquire a slot, waits for one if wait is set. false once stopped, or
+// when there's no free slot and wait is not set.
+func (w *window) acquire(wait bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.stopped && w.n >= w.max {
+		if !wait {
+			return false
+		}
+		w.cond.Wait()
+	}
+	if w.stopped {
+		return false
+	}
+	w.n++
+	return true
+}
+
+func (w *window) release() {
+	w.mu.Lock()
+	w.n--
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *window) resize(max int) {
+	w.mu.Lock()
+	w.max = max
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// no more slots are given out
+func (w *window) stop() {
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// wait until all slots are released
+func (w *window) drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.n > 0 {
+		w.cond.Wait()
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nsq "github.com/bitly/go-nsq"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// an archiver fed by source, writing to a temporary directory
+func test_source_archiver(t *testing.T, source string) *Archiver {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := default_config()
+	cfg.DataDir = dir
+	cfg.Source = source
+	cfg.MinFreeSpace = 0
+	return &Archiver{cfg: cfg, topic: TOPIC}
+}
+
+func test_record(i int) []byte {
+	bin, _ := bson.Marshal(&RedoRecord{API: "test", UID: int32(i), TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}})
+	return bin
+}
+
+// wait for the archiver to stop, then count what's in its file
+func test_stopped(t *testing.T, arch *Archiver) *SegmentInfo {
+	select {
+	case <-arch.stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("archiver not stopped")
+	}
+	file, _, ok := latest_redolog(arch.dir)
+	if !ok {
+		t.Fatal("no redolog")
+	}
+	seg, err := arch.cfg.open_segment(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	info, err := seg.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestHTTPSource(t *testing.T) {
+	arch := test_source_archiver(t, SOURCE_HTTP)
+	defer os.RemoveAll(arch.cfg.DataDir)
+	if err := arch.init(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{cfg: arch.cfg, archivers: map[string]*Archiver{arch.topic: arch}}
+	srv := httptest.NewServer(m.pub_handler())
+	defer srv.Close()
+
+	pub := func(topic string, body []byte) (int, string) {
+		resp, err := http.Post(srv.URL+"/pub?topic="+topic, "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	// responded once committed
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if code, resp := pub(TOPIC, test_record(i)); code != http.StatusOK || resp != "OK" {
+				t.Error("not published", i, code, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if status := arch.status(); status.Received != 10 || status.Committed != 10 || status.Source != SOURCE_HTTP {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// malformed messages are committed as dead letters
+	if code, _ := pub(TOPIC, []byte("garbage")); code != http.StatusOK {
+		t.Error("garbage not published", code)
+	}
+	for _, c := range []struct {
+		topic string
+		body  []byte
+		code  int
+	}{
+		{"NOPE", test_record(1), http.StatusNotFound},
+		{"", test_record(1), http.StatusBadRequest},
+		{TOPIC, nil, http.StatusBadRequest},
+		{TOPIC, make([]byte, MAX_MSG_SIZE+1), http.StatusRequestEntityTooLarge},
+	} {
+		if code, resp := pub(c.topic, c.body); code != c.code {
+			t.Error("unexpected response", c.topic, len(c.body), code, resp)
+		}
+	}
+	if resp, err := http.Get(srv.URL + "/pub?topic=" + TOPIC); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("pub needs POST", err)
+	}
+
+	arch.pause(true)
+	if code, _ := pub(TOPIC, test_record(11)); code != http.StatusServiceUnavailable {
+		t.Error("published while paused", code)
+	}
+	arch.pause(false)
+
+	arch.shutdown()
+	if info := test_stopped(t, arch); info.Records != 10 || info.DeadLetters != 1 {
+		t.Fatalf("unexpected file %+v", info)
+	}
+	if code, _ := pub(TOPIC, test_record(12)); code != http.StatusServiceUnavailable {
+		t.Error("published after shutdown", code)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	arch := test_source_archiver(t, SOURCE_FILE)
+	defer os.RemoveAll(arch.cfg.DataDir)
+
+	var stream bytes.Buffer
+	for i := 1; i <= 100; i++ {
+		stream.Write(test_record(i))
+	}
+	bad, _ := bson.Marshal(bson.M{"x": 1})
+	stream.Write(bad)
+	arch.cfg.Input = filepath.Join(arch.cfg.DataDir, "stream.bson")
+	if err := ioutil.WriteFile(arch.cfg.Input, stream.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// stops by itself at the end of the stream, everything committed
+	if err := arch.init(); err != nil {
+		t.Fatal(err)
+	}
+	if info := test_stopped(t, arch); info.Records != 100 || info.DeadLetters != 1 {
+		t.Fatalf("unexpected file %+v", info)
+	}
+	if status := arch.status(); status.Received != 101 || status.Rejected != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestFileSourceRequeue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var stream bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		stream.Write(test_record(i))
+	}
+	stream.Write([]byte{0xff, 0, 0}) // torn document at the end
+	file := filepath.Join(dir, "stream.bson")
+	ioutil.WriteFile(file, stream.Bytes(), 0600)
+
+	// the first message is requeued once, and delivered again before reading on
+	var delivered []*nsq.Message
+	s := new_file_source(file, 1)
+	s.Start(func(msg *nsq.Message) {
+		delivered = append(delivered, msg)
+		if len(delivered) == 1 {
+			msg.RequeueWithoutBackoff(-1)
+		} else {
+			msg.Finish()
+		}
+	})
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not exhausted")
+	}
+	if len(delivered) != 4 || s.finished != 3 {
+		t.Fatal("unexpected deliveries", len(delivered), s.finished)
+	}
+	if retry := delivered[1]; retry.ID != delivered[0].ID || retry.Attempts != 2 || !bytes.Equal(retry.Body, delivered[0].Body) {
+		t.Error("requeued message not delivered again", string(retry.ID[:]), retry.Attempts)
+	}
+	if delivered[0].NSQDAddress != file {
+		t.Error("unexpected address", delivered[0].NSQDAddress)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	MIN_FREE_SPACE      = 256 << 20 // low-water mark of the data volume, in bytes
+	DISK_CHECK_INTERVAL = 10 * time.Second
+)
+
+// free bytes of the volume dir is on, available to unprivileged users
+func free_space(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+func (arch *Archiver) is_stalled() bool {
+	return atomic.LoadInt32(&arch.stalled) == 1
+}
+
+func (arch *Archiver) is_paused() bool {
+	return atomic.LoadInt32(&arch.paused) == 1
+}
+
+// the source delivers messages unless stalled or paused
+func (arch *Archiver) update_flow() {
+	arch.flow.Lock()
+	defer arch.flow.Unlock()
+	if arch.source == nil {
+		return
+	}
+	if arch.is_stalled() || arch.is_paused() {
+		arch.source.ChangeMaxInFlight(0)
+	} else {
+		arch.source.ChangeMaxInFlight(arch.max_in_flight)
+	}
+}
+
+// stop pulling from the source, messages not committed yet stay in the source
+func (arch *Archiver) stall(reason error) {
+	if !atomic.CompareAndSwapInt32(&arch.stalled, 0, 1) {
+		return
+	}
+	atomic.AddUint64(&arch.stalls, 1)
+	log.Warnf("%v stalled: %v", arch.topic, reason)
+	arch.update_flow()
+}
+
+// resume pulling from the source after a stall
+func (arch *Archiver) resume() {
+	if !atomic.CompareAndSwapInt32(&arch.stalled, 1, 0) {
+		return
+	}
+	log.Infof("%v resumed", arch.topic)
+	arch.update_flow()
+}
+
+// pause or resume consumption by hand, independent of stalls
+func (arch *Archiver) pause(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	if atomic.SwapInt32(&arch.paused, v) != v {
+		log.Infof("%v paused: %v", arch.topic, paused)
+		arch.update_flow()
+	}
+}
+
+// stall if the data volume is below the low-water mark, returns false if stalled
+func (arch *Archiver) check_disk() bool {
+	if arch.cfg.MinFreeSpace <= 0 {
+		return true
+	}
+	free, err := free_space(arch.dir)
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	if free < uint64(arch.cfg.MinFreeSpace) {
+		arch.stall(fmt.Errorf("%v bytes free on %v, below %v", free, arch.dir, arch.cfg.MinFreeSpace))
+		return false
+	}
+	return true
+}
+
+// give pending messages back to the source, without backing off
+func (arch *Archiver) requeue(n int) {
+	for i := 0; i < n; i++ {
+		(<-arch.pending).msg.RequeueWithoutBackoff(-1)
+	}
+}
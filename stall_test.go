@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStall(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+
+	// a file that can't be created is an error, not a panic
+	if _, err := arch.new_redolog(filepath.Join(arch.dir, "missing", "x.RDO"), time.Now(), nil); err == nil {
+		t.Fatal("expect error creating file in a missing directory")
+	}
+
+	// a failed commit gives the messages back to nsq
+	rl := test_open(t, arch)
+	rl.Close()
+	d := new(test_delegate)
+	for i := 1; i <= 3; i++ {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		arch.pending <- new_entry(test_message(d, i, r))
+	}
+	err := arch.commit(rl, len(arch.pending))
+	if err == nil || d.requeued != 3 || d.finished != 0 {
+		t.Fatal("failed commit should requeue", err, d.requeued, d.finished)
+	}
+
+	arch.stall(err)
+	arch.stall(err)
+	if !arch.is_stalled() || arch.stalls != 1 {
+		t.Fatal("not stalled", arch.stalls)
+	}
+	arch.resume()
+	if arch.is_stalled() {
+		t.Fatal("not resumed")
+	}
+
+	// low-water mark
+	arch.cfg.MinFreeSpace = math.MaxInt64
+	if arch.check_disk() || !arch.is_stalled() {
+		t.Fatal("should stall below the low-water mark")
+	}
+	arch.cfg.MinFreeSpace = 1
+	if !arch.check_disk() {
+		t.Fatal("should pass above the low-water mark")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// a RDO file is a segment of a storage backend, chosen by -storage for new
+// files. the backend of an existing file is recognised by its content, so
+// files of both backends can be mixed in a directory.
+const (
+	STORAGE_BOLT    = "bolt"    // a bolt database with secondary indexes
+	STORAGE_SEGMENT = "segment" // an append-only file with a sparse offset index, see segment.go
+)
+
+var (
+	ERR_LOCKED         = errors.New("locked by a running archiver")
+	ERR_SEGMENT_CLOSED = errors.New("segment closed")
+)
+
+// a record to append, sequences start from 1 in each segment
+type Record struct {
+	Seq   uint64
+	Value []byte      // encoded by the codec
+	Hash  []byte      // chain hash, see chain.go
+	Rec   *RedoRecord // decoded record, for the backends keeping indexes
+}
+
+// Batch is appended to a segment atomically
+type Batch struct {
+	Records     []Record
+	DeadLetters []Record // sequenced apart from the records, without hash
+}
+
+// SegmentInfo summarizes a segment, it's gathered by a full scan
+type SegmentInfo struct {
+	Records     uint64 // records in segment
+	DeadLetters uint64 // dead letters in segment
+	FirstSeq    uint64 // first record sequence
+	LastSeq     uint64 // last record sequence
+	MinTS       uint64 // minimum millisecond of TS, 0 if unknown
+	MaxTS       uint64 // maximum millisecond of TS, 0 if unknown
+	KeyID       string // id of the key encrypting the segment
+	Chained     bool   // records are hash chained
+	PrevHash    []byte // last hash of the previous segment
+	LastHash    []byte // hash the next record chains to
+}
+
+// Segment is an opened RDO file
+type Segment interface {
+	// append a batch, durable on return unless opened with no-sync
+	Append(b *Batch) error
+	// the stored value of a record, nil if not found
+	Get(seq uint64) ([]byte, error)
+	// records, or dead letters if dead is set, from sequence from on in
+	// sequence order. hash is the chain hash of a record, nil for dead letters.
+	Iterate(dead bool, from uint64, fn func(seq uint64, v, hash []byte) error) error
+	// the last record and dead letter sequences, and the hash the next
+	// record chains to
+	Tail() (records, dead_letters uint64, hash []byte)
+	KeyID() string
+	Info() (*SegmentInfo, error)
+	Size() int64
+	// write a consistent copy to w, appends go on meanwhile.
+	// returns the records and bytes copied.
+	Snapshot(w io.Writer) (records uint64, n int64, err error)
+	Sync() error
+	Close() error
+}
+
+// Storage opens the segments of a backend
+type Storage interface {
+	// open a segment to append to, a new one chains to prev and is
+	// encrypted with key_id. no-sync skips the fsync of appends.
+	Create(file string, prev []byte, key_id string, nosync bool) (Segment, error)
+	// open a closed segment read-only, ERR_LOCKED if it's being written
+	Open(file string) (Segment, error)
+	// rewrite a closed segment for long term storage, before its manifest is written
+	Seal(file string) error
+}
+
+// the backend writing new files
+func (cfg *Config) storage() Storage {
+	if cfg.Storage == STORAGE_SEGMENT {
+		return segment_storage{}
+	}
+	return bolt_storage{cfg.Bucket}
+}
+
+// the backend of an existing file
+func (cfg *Config) file_storage(file string) (Storage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(SEGMENT_MAGIC))
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, []byte(SEGMENT_MAGIC)) {
+		return segment_storage{}, nil
+	} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return bolt_storage{cfg.Bucket}, nil
+}
+
+// open an existing file read-only with its own backend
+func (cfg *Config) open_segment(file string) (Segment, error) {
+	st, err := cfg.file_storage(file)
+	if err != nil {
+		return nil, err
+	}
+	return st.Open(file)
+}
+
+func (st bolt_storage) String() string    { return STORAGE_BOLT }
+func (st segment_storage) String() string { return STORAGE_SEGMENT }
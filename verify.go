@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const VERIFY_MAX_PROBLEMS = 100 // problems listed per file
+
+// checks of verify
+const (
+	CHECK_OPEN     = "open"
+	CHECK_CRC      = "crc"
+	CHECK_SEQUENCE = "sequence"
+	CHECK_DECODE   = "decode"
+	CHECK_CHAIN    = "chain"
+)
+
+// VerifyReport is the result of verifying a RDO file, printed as a line of json
+type VerifyReport struct {
+	File        string          `json:"file"`
+	Records     uint64          `json:"records"`            // records checked
+	DeadLetters uint64          `json:"dead_letters"`       // dead letters checked
+	Unchecked   uint64          `json:"unchecked"`          // values written without CRC
+	Corrupt     uint64          `json:"corrupt"`            // problems found
+	Problems    []VerifyProblem `json:"problems,omitempty"` // the first VERIFY_MAX_PROBLEMS problems
+	Skipped     string          `json:"skipped,omitempty"`  // why the file is not verified
+	Note        string          `json:"note,omitempty"`
+}
+
+type VerifyProblem struct {
+	Bucket string `json:"bucket,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Check  string `json:"check"`
+	Error  string `json:"error"`
+}
+
+// VerifySummary is printed as the last line of the report
+type VerifySummary struct {
+	Files       int    `json:"files"`
+	Skipped     int    `json:"skipped"`
+	Records     uint64 `json:"records"`
+	Corrupt     int    `json:"corrupt"`                // corrupted files
+	FirstBroken string `json:"first_broken,omitempty"` // file:seq of the first broken link of the hash chain
+}
+
+func (r *VerifyReport) problem(bucket string, seq uint64, check string, err error) {
+	r.Corrupt++
+	if len(r.Problems) < VERIFY_MAX_PROBLEMS {
+		r.Problems = append(r.Problems, VerifyProblem{bucket, seq, check, err.Error()})
+	}
+}
+
+// verify all RDO files under the data dir, a json report per file is written
+// to w, followed by a summary. returns false if any file is corrupted.
+func verify_data(cfg *Config, w io.Writer) (bool, error) {
+	var files []string
+	err := filepath.Walk(cfg.DataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".RDO") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(files) // by directory, then by creation time
+
+	enc := json.NewEncoder(w)
+	var sum VerifySummary
+	var prev []byte // last hash of the previous file in the same directory, nil if unknown
+	for i, file := range files {
+		if i > 0 && filepath.Dir(file) != filepath.Dir(files[i-1]) {
+			prev = nil
+		}
+		r, last := verify_file(cfg, file, prev)
+		prev = last
+		if err := enc.Encode(r); err != nil {
+			return false, err
+		}
+		for _, p := range r.Problems {
+			if p.Check == CHECK_CHAIN && sum.FirstBroken == "" {
+				sum.FirstBroken = fmt.Sprintf("%v:%v", file, p.Seq)
+			}
+		}
+		sum.Files++
+		sum.Records += r.Records
+		if r.Skipped != "" {
+			sum.Skipped++
+		}
+		if r.Corrupt > 0 {
+			sum.Corrupt++
+		}
+	}
+	if err := enc.Encode(sum); err != nil {
+		return false, err
+	}
+	return sum.Corrupt == 0, nil
+}
+
+// check the CRC, sequence continuity, decoding and hash chain of every value
+// in a RDO file, prev is the last hash of the previous file, nil if unknown.
+// returns the last hash of the file.
+func verify_file(cfg *Config, file string, prev []byte) (r *VerifyReport, last []byte) {
+	r = &VerifyReport{File: file}
+	seg, err := cfg.open_segment(file)
+	if err == ERR_LOCKED {
+		r.Skipped = err.Error()
+		return r, nil
+	} else if err != nil {
+		r.problem("", 0, CHECK_OPEN, err)
+		return r, nil
+	}
+	defer seg.Close()
+
+	c, err := cfg.codec(seg.KeyID())
+	if err != nil {
+		// CRCs and sequences are still checked
+		r.Note = fmt.Sprintf("%v, records not decoded", err)
+		c = &codec{}
+	}
+	// records archived before validation may not hold its invariants,
+	// they're only decoded
+	r.Records = r.verify_values(seg, false, cfg.Bucket, c, func(bin []byte) error {
+		return bson.Unmarshal(bin, new(RedoRecord))
+	})
+	r.DeadLetters = r.verify_values(seg, true, DEADLETTER_BUCKET, c, func(bin []byte) error {
+		return bson.Unmarshal(bin, new(DeadLetter))
+	})
+	last = r.verify_chain(seg, prev)
+
+	if m, err := read_manifest(file); err != nil {
+		r.problem("", 0, CHECK_OPEN, err)
+	} else if m != nil && m.LastHash != hex.EncodeToString(last) {
+		r.problem(CHAIN_BUCKET, 0, CHECK_CHAIN, fmt.Errorf("last hash %x, manifest has %v", last, m.LastHash))
+	}
+	return r, last
+}
+
+// recompute the hash of each record from the stored hash of the previous one,
+// so each edited, removed or reordered record breaks its own link.
+// returns the last hash.
+func (r *VerifyReport) verify_chain(seg Segment, prev []byte) []byte {
+	info, err := seg.Info()
+	if err != nil {
+		r.problem(CHAIN_BUCKET, 0, CHECK_OPEN, err)
+		return nil
+	}
+	if !info.Chained {
+		r.Note = "not chained"
+		return nil
+	}
+
+	last := info.PrevHash
+	if prev != nil && !bytes.Equal(last, prev) {
+		r.problem(CHAIN_BUCKET, 0, CHECK_CHAIN, fmt.Errorf("chains to %x, previous file ends with %x", last, prev))
+	}
+	// a broken read is reported by verify_values
+	seg.Iterate(false, 0, func(seq uint64, v, h []byte) error {
+		expect := chain_hash(last, seq_key(seq), v)
+		if !bytes.Equal(h, expect) {
+			r.problem(CHAIN_BUCKET, seq, CHECK_CHAIN, fmt.Errorf("hash %x, expect %x", h, expect))
+		}
+		if h == nil {
+			h = expect
+		}
+		last = append(last[:0:0], h...)
+		return nil
+	})
+	return append([]byte{}, last...)
+}
+
+// records or dead letters are sequences from 1, values are decoded by decode
+func (r *VerifyReport) verify_values(seg Segment, dead bool, name string, c *codec, decode func([]byte) error) (n uint64) {
+	var prev uint64
+	err := seg.Iterate(dead, 0, func(seq uint64, v, _ []byte) error {
+		n++
+		if seq != prev+1 {
+			r.problem(name, seq, CHECK_SEQUENCE, fmt.Errorf("expect sequence %v", prev+1))
+		}
+		prev = seq
+
+		if v == nil {
+			r.problem(name, seq, CHECK_DECODE, fmt.Errorf("nested bucket"))
+			return nil
+		}
+		if len(v) > 0 && (is_bson(v) || v[0]&FLAG_CRC32C == 0) {
+			r.Unchecked++
+		}
+		bin, err := decode_value(seq_key(seq), v, c.aead)
+		switch {
+		case err == ERR_NO_KEY:
+		case err == ERR_CHECKSUM:
+			r.problem(name, seq, CHECK_CRC, err)
+		case err != nil:
+			r.problem(name, seq, CHECK_DECODE, err)
+		default:
+			if err := decode(bin); err != nil {
+				r.problem(name, seq, CHECK_DECODE, err)
+			}
+		}
+		return nil
+	})
+	// the rest of the file can't be read
+	if err == ERR_CHECKSUM {
+		r.problem(name, prev+1, CHECK_CRC, err)
+	} else if err != nil {
+		r.problem(name, prev+1, CHECK_SEQUENCE, err)
+	}
+	return n
+}
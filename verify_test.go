@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestVerify(t *testing.T) {
+	arch := test_archiver(t)
+	defer os.RemoveAll(arch.dir)
+	rl := test_open(t, arch)
+
+	d := new(test_delegate)
+	for i := 1; i <= 10; i++ {
+		r := RedoRecord{API: "test", UID: 1, TS: ts(), Changes: []Change{{Collection: "test", Doc: testdoc{"name", i}}}}
+		if i == 2 {
+			r.UID = 0 // archived before validation
+		}
+		e := new_entry(test_message(d, i, r))
+		if i == 2 {
+			e.rec = &r
+		}
+		arch.pending <- e
+	}
+	arch.pending <- new_entry(test_message(d, 11, []byte("garbage")))
+	if err := arch.commit(rl, len(arch.pending)); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	r, _ := verify_file(arch.cfg, rl.file, nil)
+	if r.Corrupt != 0 || r.Records != 10 || r.DeadLetters != 1 || r.Unchecked != 0 {
+		t.Fatalf("clean file reported: %+v", r)
+	}
+
+	// flip a bit of record 3, drop record 5, record 7 is not a redo record
+	db, err := bolt.Open(rl.file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(arch.cfg.Bucket))
+		key := func(seq uint64) []byte {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			return k
+		}
+		v := append([]byte(nil), b.Get(key(3))...)
+		v[len(v)/2] ^= 1
+		if err := b.Put(key(3), v); err != nil {
+			return err
+		}
+		if err := b.Delete(key(5)); err != nil {
+			return err
+		}
+		v, _ = rl.codec.encode(key(7), []byte("garbage"))
+		return b.Put(key(7), v)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = verify_file(arch.cfg, rl.file, nil)
+	expect := []VerifyProblem{
+		{Bucket: arch.cfg.Bucket, Seq: 3, Check: CHECK_CRC},
+		{Bucket: arch.cfg.Bucket, Seq: 6, Check: CHECK_SEQUENCE},
+		{Bucket: arch.cfg.Bucket, Seq: 7, Check: CHECK_DECODE},
+		{Bucket: CHAIN_BUCKET, Seq: 3, Check: CHECK_CHAIN},
+		{Bucket: CHAIN_BUCKET, Seq: 6, Check: CHECK_CHAIN},
+		{Bucket: CHAIN_BUCKET, Seq: 7, Check: CHECK_CHAIN},
+	}
+	if len(r.Problems) != len(expect) {
+		t.Fatalf("expect %v problems, got %+v", len(expect), r.Problems)
+	}
+	for i, p := range r.Problems {
+		if p.Bucket != expect[i].Bucket || p.Seq != expect[i].Seq || p.Check != expect[i].Check {
+			t.Errorf("expect %+v, got %+v", expect[i], p)
+		}
+	}
+
+	var out bytes.Buffer
+	ok, err := verify_data(arch.cfg, &out)
+	if err != nil || ok {
+		t.Fatal("corruption not reported", ok, err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	var sum VerifySummary
+	if err := json.Unmarshal(lines[len(lines)-1], &sum); err != nil || sum.Files != 1 || sum.Corrupt != 1 || sum.Records != 9 || sum.FirstBroken != rl.file+":3" {
+		t.Errorf("bad summary %s: %v", lines[len(lines)-1], err)
+	}
+}